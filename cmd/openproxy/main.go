@@ -1,13 +1,17 @@
 package main
 
 import (
+	"bufio"
 	"flag"
+	"fmt"
 	"log"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
+	"openproxy/internal/audit"
 	"openproxy/internal/client"
 	"openproxy/internal/config"
 	"openproxy/internal/server"
@@ -15,6 +19,11 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "hash-password" {
+		hashPassword()
+		return
+	}
+
 	configPath := flag.String("c", "config.yaml", "Path to configuration file")
 	flag.Parse()
 
@@ -27,12 +36,20 @@ func main() {
 		log.Fatalf("Invalid config: %v", err)
 	}
 
+	var auditLog *audit.Log
+	if !cfg.Audit.Disabled {
+		if auditLog, err = audit.Open(cfg.Audit); err != nil {
+			log.Fatalf("Failed to open audit log: %v", err)
+		}
+	}
+
 	var provider web.StatusProvider
 
 	if cfg.Mode == "server" {
 		srv := server.NewServer(&cfg.Server)
+		srv.Audit = auditLog
 		provider = srv
-		
+
 		// Start Server in goroutine
 		go func() {
 			if err := srv.Start(); err != nil {
@@ -42,7 +59,7 @@ func main() {
 	} else {
 		cli := client.NewClient(&cfg.Client)
 		provider = cli
-		
+
 		// Start Client in goroutine
 		go func() {
 			// Basic reconnect loop
@@ -60,7 +77,7 @@ func main() {
 
 	// Start Web UI
 	go func() {
-		if err := web.Start(cfg, *configPath, provider); err != nil {
+		if err := web.Start(cfg, *configPath, provider, auditLog); err != nil {
 			log.Printf("Web UI error: %v", err)
 		}
 	}()
@@ -70,4 +87,23 @@ func main() {
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	<-c
 	log.Println("Shutting down...")
-}
\ No newline at end of file
+}
+
+// hashPassword reads a password from stdin and prints its hash for web.users in the config.
+// The password is not taken as an argument so it stays out of the shell history.
+func hashPassword() {
+	fmt.Fprint(os.Stderr, "Password: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		log.Fatalf("Failed to read password: %v", err)
+	}
+	password := strings.TrimRight(line, "\r\n")
+	if password == "" {
+		log.Fatalf("Password must not be empty")
+	}
+	hash, err := web.HashPassword(password)
+	if err != nil {
+		log.Fatalf("Failed to hash password: %v", err)
+	}
+	fmt.Println(hash)
+}
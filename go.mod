@@ -3,6 +3,15 @@ module openproxy
 go 1.23
 
 require (
-	github.com/gorilla/websocket v1.5.3 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
+	github.com/golang/snappy v1.0.0
+	github.com/gorilla/websocket v1.5.3
+	github.com/klauspost/compress v1.18.0
+	golang.org/x/crypto v0.33.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
+	golang.org/x/net v0.21.0 // indirect
+	golang.org/x/sys v0.30.0 // indirect
+	golang.org/x/text v0.22.0 // indirect
 )
@@ -0,0 +1,149 @@
+package api
+
+import (
+	"time"
+
+	"openproxy/internal/config"
+)
+
+// Tunnel is a tunnel as reported by /api/v1/tunnels.
+type Tunnel struct {
+	Name          string   `json:"name"`
+	Protocol      string   `json:"protocol"`
+	RemotePort    int      `json:"remote_port"`
+	CustomDomains []string `json:"custom_domains,omitempty"`
+	Locations     []string `json:"locations,omitempty"`
+	Compression   string   `json:"compression,omitempty"`
+	UseEncryption bool     `json:"use_encryption"`
+	ActiveConns   int64    `json:"active_conns"`
+	BytesIn       int64    `json:"bytes_in"`
+	BytesOut      int64    `json:"bytes_out"`
+	Session       string   `json:"session,omitempty"` // Server mode: session that registered the tunnel
+
+	// Client mode: the configured tunnel, with secrets masked
+	Config *config.Tunnel `json:"config,omitempty"`
+}
+
+// Session is a control connection between a client and the server.
+type Session struct {
+	ID         string    `json:"id"`
+	RemoteAddr string    `json:"remote_addr"` // The client on the server, the server on the client
+	StartTime  time.Time `json:"start_time"`
+	LastSeen   time.Time `json:"last_seen"`
+	RTTMs      float64   `json:"rtt_ms"`
+	PoolIdle   int       `json:"pool_idle"`
+	Tunnels    []string  `json:"tunnels"`
+}
+
+// Connection states
+const (
+	ConnPending = "pending" // Waiting for the client to open a data connection
+	ConnActive  = "active"
+)
+
+// Connection is a proxied connection through a tunnel.
+type Connection struct {
+	ID         string    `json:"id"`
+	Tunnel     string    `json:"tunnel"`
+	RemoteAddr string    `json:"remote_addr,omitempty"` // Public source on the server
+	StartTime  time.Time `json:"start_time"`
+	State      string    `json:"state"`
+	BytesIn    int64     `json:"bytes_in"`  // From the public side on the server, from the server on the client
+	BytesOut   int64     `json:"bytes_out"` // Toward the public side on the server, toward the server on the client
+	RateIn     float64   `json:"rate_in"`   // Bytes per second over the last sample interval
+	RateOut    float64   `json:"rate_out"`
+}
+
+type TunnelList struct {
+	Tunnels []Tunnel `json:"tunnels"`
+}
+
+type SessionList struct {
+	Sessions []Session `json:"sessions"`
+}
+
+type ConnectionList struct {
+	Connections []Connection `json:"connections"`
+}
+
+// Audited actions
+const (
+	AuditLogin            = "login"
+	AuditConfigSave       = "config_save"
+	AuditConfigRollback   = "config_rollback"
+	AuditTunnelAdd        = "tunnel_add"
+	AuditTunnelUpdate     = "tunnel_update"
+	AuditTunnelRemove     = "tunnel_remove"
+	AuditTokenCreate      = "token_create"
+	AuditTokenRevoke      = "token_revoke"
+	AuditConnKill         = "conn_kill"
+	AuditClientAuth       = "client_auth"       // Server mode: a client opened a control connection
+	AuditTunnelRegister   = "tunnel_register"   // Server mode: a client registered a tunnel
+	AuditTunnelUnregister = "tunnel_unregister" // Server mode: a client released a tunnel
+	AuditSessionKick      = "session_kick"      // Server mode: a client session was dropped
+)
+
+// AuditEntry is one line of the audit log.
+type AuditEntry struct {
+	Time     time.Time     `json:"time"`
+	Action   string        `json:"action"`
+	Actor    string        `json:"actor,omitempty"` // Web user, API token or client session
+	SourceIP string        `json:"source_ip,omitempty"`
+	Target   string        `json:"target,omitempty"` // Tunnel, token, connection or session acted on
+	Success  bool          `json:"success"`
+	Message  string        `json:"message,omitempty"` // Why it failed, or details
+	Changes  []AuditChange `json:"changes,omitempty"`
+}
+
+// AuditChange is a setting changed by an audited action. Secrets are masked.
+type AuditChange struct {
+	Field string      `json:"field"` // Path of the setting, like client.tunnels[web].local_addr
+	Old   interface{} `json:"old,omitempty"`
+	New   interface{} `json:"new,omitempty"`
+}
+
+type AuditLog struct {
+	Entries []AuditEntry `json:"entries"` // Newest first
+}
+
+// Error codes returned by the v1 API
+const (
+	CodeBadRequest         = "bad_request"
+	CodeUnauthorized       = "unauthorized"
+	CodeForbidden          = "forbidden"
+	CodeNotFound           = "not_found"
+	CodeMethodNotAllowed   = "method_not_allowed"
+	CodeConflict           = "conflict"
+	CodePreconditionFailed = "precondition_failed"   // The config changed since the If-Match ETag was read
+	CodePreconditionReq    = "precondition_required" // The save must name the config it is based on with If-Match
+	CodeUnsupported        = "unsupported"           // Not available in the current mode
+	CodeRegistrationFailed = "registration_failed"   // The server refused the tunnel
+	CodeInternal           = "internal"
+)
+
+type Error struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// ConfigSaved is returned once a new config has been written.
+type ConfigSaved struct {
+	Message         string `json:"message"`
+	RestartRequired bool   `json:"restart_required"`
+}
+
+type ConfigVersionList struct {
+	Versions []config.Version `json:"versions"` // Newest first
+}
+
+// ConfigVersion is an earlier version of the config file with the settings it
+// differs in from the current config.
+type ConfigVersion struct {
+	config.Version
+	Changes []AuditChange `json:"changes"` // Old values are the version's, new ones the current config's
+}
+
+// ErrorResponse is the body of every failed v1 request.
+type ErrorResponse struct {
+	Error Error `json:"error"`
+}
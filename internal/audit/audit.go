@@ -0,0 +1,364 @@
+// Package audit keeps an append-only log of administrative actions and security
+// events, one JSON object per line, so it can be told later who changed what.
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"openproxy/internal/api"
+	"openproxy/internal/config"
+)
+
+const (
+	defaultPath       = "audit.log"
+	defaultMaxSize    = 100 // MiB
+	defaultMaxBackups = 5
+	DefaultLimit      = 100
+	MaxLimit          = 1000
+
+	maxLineSize   = 4 * 1024 * 1024 // Longer lines are skipped by Query, config saves carry large diffs
+	limitInterval = time.Minute     // Of RecordLimited
+)
+
+// Log is the audit log. A nil Log records nothing, so callers need not check
+// whether auditing is enabled.
+type Log struct {
+	path       string
+	file       *os.File
+	size       int64 // Of file
+	maxSize    int64
+	maxBackups int
+	limited    map[string]*limitState // By RecordLimited key
+	mu         sync.Mutex
+}
+
+// limitState counts the entries of one RecordLimited key left out since the last one recorded.
+type limitState struct {
+	last       time.Time
+	entry      api.AuditEntry
+	suppressed int
+}
+
+// Open opens the log at the path in cfg for appending.
+func Open(cfg config.AuditConfig) (*Log, error) {
+	l := &Log{
+		path:       cfg.Path,
+		maxSize:    int64(cfg.MaxSize) * 1024 * 1024,
+		maxBackups: cfg.MaxBackups,
+		limited:    make(map[string]*limitState),
+	}
+	if l.path == "" {
+		l.path = defaultPath
+	}
+	if l.maxSize <= 0 {
+		l.maxSize = defaultMaxSize * 1024 * 1024
+	}
+	if l.maxBackups <= 0 {
+		l.maxBackups = defaultMaxBackups
+	}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *Log) open() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.file, l.size = f, info.Size()
+	return nil
+}
+
+// backupPath returns the path of the nth rotated file, 0 being the current one.
+func (l *Log) backupPath(n int) string {
+	if n == 0 {
+		return l.path
+	}
+	return fmt.Sprintf("%s.%d", l.path, n)
+}
+
+// rotate moves the current file to path.1, shifting older ones up and dropping
+// the oldest beyond maxBackups, and starts a new file. Called with mu held.
+func (l *Log) rotate() error {
+	l.file.Close()
+	os.Remove(l.backupPath(l.maxBackups))
+	for n := l.maxBackups - 1; n >= 0; n-- {
+		os.Rename(l.backupPath(n), l.backupPath(n+1))
+	}
+	return l.open()
+}
+
+// Record appends e to the log, stamped with the current time unless it has one.
+func (l *Log) Record(e api.AuditEntry) {
+	if l == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("Failed to encode audit entry: %v", err)
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// One write per line, so a crash can only tear the last entry
+	n, err := l.file.Write(append(data, '\n'))
+	l.size += int64(n)
+	if err != nil {
+		log.Printf("Failed to write audit log: %v", err)
+	}
+	if l.size >= l.maxSize {
+		if err := l.rotate(); err != nil {
+			log.Printf("Failed to rotate audit log: %v", err)
+		}
+	}
+}
+
+// RecordLimited appends e unless an entry with the same key was recorded in the
+// last limitInterval, for events anyone can cause, like failed authentication
+// keyed by source IP, so they cannot fill the disk. How many entries were left
+// out is noted on the next one recorded for the key.
+func (l *Log) RecordLimited(key string, e api.AuditEntry) {
+	if l == nil {
+		return
+	}
+	now := time.Now()
+	var record []api.AuditEntry
+	l.mu.Lock()
+	for k, st := range l.limited {
+		if now.Sub(st.last) < limitInterval || k == key {
+			continue
+		}
+		// Quiet again, account for what was left out
+		if st.suppressed > 0 {
+			record = append(record, suppressedEntry(st))
+		}
+		delete(l.limited, k)
+	}
+	st := l.limited[key]
+	switch {
+	case st != nil && now.Sub(st.last) < limitInterval:
+		st.suppressed++
+		st.entry = e
+	case st != nil && st.suppressed > 0:
+		e.Message += fmt.Sprintf(" (%d similar entries since %s not recorded)", st.suppressed, st.last.Format(time.RFC3339))
+		fallthrough
+	default:
+		l.limited[key] = &limitState{last: now}
+		record = append(record, e)
+	}
+	l.mu.Unlock()
+
+	for _, e := range record {
+		l.Record(e)
+	}
+}
+
+// suppressedEntry summarises the entries RecordLimited left out for st.
+func suppressedEntry(st *limitState) api.AuditEntry {
+	e := st.entry
+	e.Time = time.Time{}
+	e.Message += fmt.Sprintf(" (%d similar entries since %s not recorded)", st.suppressed, st.last.Format(time.RFC3339))
+	return e
+}
+
+// SourceIP returns the host of a remote address, or addr itself if it has no port.
+func SourceIP(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// Filter selects entries of the log. Empty fields match everything.
+type Filter struct {
+	Action   string
+	Actor    string
+	Target   string
+	SourceIP string
+	Success  *bool
+	Since    time.Time
+	Until    time.Time
+	Limit    int // At most MaxLimit, DefaultLimit if zero
+}
+
+func (f Filter) match(e api.AuditEntry) bool {
+	return (f.Action == "" || e.Action == f.Action) &&
+		(f.Actor == "" || e.Actor == f.Actor) &&
+		(f.Target == "" || e.Target == f.Target) &&
+		(f.SourceIP == "" || e.SourceIP == f.SourceIP) &&
+		(f.Success == nil || e.Success == *f.Success) &&
+		(f.Since.IsZero() || !e.Time.Before(f.Since)) &&
+		(f.Until.IsZero() || e.Time.Before(f.Until))
+}
+
+// Query returns the newest entries matching f, newest first.
+func (l *Log) Query(f Filter) ([]api.AuditEntry, error) {
+	if f.Limit <= 0 {
+		f.Limit = DefaultLimit
+	}
+	if f.Limit > MaxLimit {
+		f.Limit = MaxLimit
+	}
+
+	// Keep the last Limit matches in a ring while reading the files from the oldest
+	ring := make([]api.AuditEntry, 0, f.Limit)
+	next := 0
+	add := func(line []byte) {
+		var e api.AuditEntry
+		if err := json.Unmarshal(line, &e); err != nil || !f.match(e) {
+			return
+		}
+		if len(ring) < f.Limit {
+			ring = append(ring, e)
+		} else {
+			ring[next] = e
+		}
+		next = (next + 1) % f.Limit
+	}
+	for n := l.maxBackups; n >= 0; n-- {
+		file, err := os.Open(l.backupPath(n))
+		if os.IsNotExist(err) && n > 0 {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		err = readLines(file, add)
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	entries := make([]api.AuditEntry, 0, len(ring))
+	for i := 0; i < len(ring); i++ {
+		entries = append(entries, ring[(next-1-i+2*len(ring))%len(ring)])
+	}
+	return entries, nil
+}
+
+// readLines calls fn with every line of r, skipping lines longer than maxLineSize.
+// The line passed to fn is only valid until it returns.
+func readLines(r io.Reader, fn func([]byte)) error {
+	br := bufio.NewReaderSize(r, 64*1024)
+	var line []byte
+	tooLong := false
+	for {
+		chunk, isPrefix, err := br.ReadLine()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !tooLong {
+			line = append(line, chunk...)
+			tooLong = len(line) > maxLineSize
+		}
+		if !isPrefix {
+			if !tooLong {
+				fn(line)
+			}
+			line, tooLong = line[:0], false
+		}
+	}
+}
+
+// Diff returns the settings that differ between old and new, compared as JSON.
+// The values reported are taken from shownOld and shownNew, copies of old and
+// new with their secrets masked, so a changed secret is noted without being
+// written to the log. Either side may be nil for something added or removed.
+func Diff(old, new, shownOld, shownNew interface{}) []api.AuditChange {
+	before, after := flatten(old), flatten(new)
+	shownBefore, shownAfter := flatten(shownOld), flatten(shownNew)
+
+	fields := make(map[string]bool)
+	for k := range before {
+		fields[k] = true
+	}
+	for k := range after {
+		fields[k] = true
+	}
+	var changes []api.AuditChange
+	for field := range fields {
+		if reflect.DeepEqual(before[field], after[field]) {
+			continue
+		}
+		changes = append(changes, api.AuditChange{Field: field, Old: shownBefore[field], New: shownAfter[field]})
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Field < changes[j].Field })
+	return changes
+}
+
+// flatten maps the path of every value in the JSON form of v to the value.
+// Lists of identified items are keyed by id or name, so removing one item does
+// not show every following one as changed.
+func flatten(v interface{}) map[string]interface{} {
+	out := make(map[string]interface{})
+	if v == nil || (reflect.ValueOf(v).Kind() == reflect.Ptr && reflect.ValueOf(v).IsNil()) {
+		return out
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return out
+	}
+	var tree interface{}
+	if err := json.Unmarshal(data, &tree); err != nil {
+		return out
+	}
+	walk("", tree, out)
+	return out
+}
+
+func walk(path string, v interface{}, out map[string]interface{}) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, child := range v {
+			if path == "" {
+				walk(k, child, out)
+			} else {
+				walk(path+"."+k, child, out)
+			}
+		}
+	case []interface{}:
+		for i, child := range v {
+			walk(fmt.Sprintf("%s[%s]", path, itemKey(child, i)), child, out)
+		}
+	default:
+		out[path] = v
+	}
+}
+
+// itemKey identifies an item of a list by its id, name or username, or else by
+// its index. Ids come first, names of API tokens need not be unique.
+func itemKey(v interface{}, i int) string {
+	if m, ok := v.(map[string]interface{}); ok {
+		for _, key := range []string{"id", "name", "username"} {
+			if s, ok := m[key].(string); ok && s != "" && !strings.ContainsAny(s, "[]") {
+				return s
+			}
+		}
+	}
+	return fmt.Sprint(i)
+}
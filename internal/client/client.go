@@ -6,25 +6,89 @@ import (
 	"io"
 	"log"
 	"net"
+	"reflect"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"openproxy/internal/api"
 	"openproxy/internal/config"
+	"openproxy/internal/conntrack"
+	"openproxy/internal/events"
+	"openproxy/internal/plugin"
 	"openproxy/internal/protocol"
+	"openproxy/internal/transport"
 )
 
 type Client struct {
 	Config      *config.ClientConfig
+	tunnels     []config.Tunnel // Current tunnels, changed by AddTunnel, UpdateTunnel and RemoveTunnel
 	controlConn net.Conn
 	mu          sync.Mutex
 	connected   bool
+	sessionID   string
+	poolCount   int
+	poolIdle    int64 // Pooled connections parked on the server, waiting for work
+	lastSeen    int64 // Unix nanoseconds of the last message from the server
+	rtt         int64 // Last measured round-trip time in nanoseconds
+
+	// Registrations waiting for their response from the control loop, by request ID
+	pendingRegs map[uint64]chan protocol.RegTunnelResponse
+	regMu       sync.Mutex
+	regSeq      uint64
+
+	visitorsOnce sync.Once
+	inspector    *inspector
+
+	events      *events.Bus
+	samplerOnce sync.Once
+	traffic     map[string]*tunnelTraffic // By tunnel name
+	trafficMu   sync.Mutex
+	conns       *conntrack.Registry // Data connections being served
+	startTime   time.Time           // Of the current control connection
 }
 
+// tunnelTraffic counts the data connections of one tunnel.
+type tunnelTraffic struct {
+	BytesIn     int64 // Received from the server
+	BytesOut    int64 // Sent to the server
+	ActiveConns int64
+
+	// Bandwidth limit shared by the data connections, set up by limiters
+	limitIn, limitOut *transport.Limiter
+}
+
+const (
+	defaultHeartbeatInterval = 10 * time.Second
+	defaultHeartbeatTimeout  = 90 * time.Second
+	registerTimeout          = 10 * time.Second
+)
+
 func NewClient(cfg *config.ClientConfig) *Client {
-	return &Client{Config: cfg}
+	return &Client{
+		Config:      cfg,
+		tunnels:     append([]config.Tunnel(nil), cfg.Tunnels...),
+		pendingRegs: make(map[uint64]chan protocol.RegTunnelResponse),
+		inspector:   newInspector(cfg.InspectLimit, cfg.InspectBodyLimit),
+		events:      events.NewBus(),
+		traffic:     make(map[string]*tunnelTraffic),
+		conns:       conntrack.NewRegistry(),
+	}
+}
+
+// Events returns the bus carrying live status changes for the Web UI.
+func (c *Client) Events() *events.Bus {
+	return c.events
 }
 
 func (c *Client) Start() error {
+	// Visitors only need the server for data connections, start them regardless of the control connection
+	c.visitorsOnce.Do(c.startVisitors)
+	c.samplerOnce.Do(func() {
+		go c.events.SampleTraffic(c.trafficSnapshot)
+		go c.conns.SampleRates()
+	})
+
 	// 1. Connect to Server
 	conn, err := net.Dial("tcp", c.Config.ServerAddr)
 	if err != nil {
@@ -36,32 +100,68 @@ func (c *Client) Start() error {
 	c.mu.Lock()
 	c.controlConn = conn
 	c.connected = true
+	c.startTime = time.Now()
 	c.mu.Unlock()
+	atomic.StoreInt64(&c.lastSeen, time.Now().UnixNano())
 
+	done := make(chan struct{})
 	defer func() {
+		close(done)
 		c.mu.Lock()
 		c.controlConn = nil
 		c.connected = false
+		c.sessionID = ""
+		c.poolCount = 0
 		c.mu.Unlock()
 		conn.Close()
+		c.events.Publish(events.ClientDisconnect, map[string]interface{}{"server_addr": c.Config.ServerAddr})
 	}()
 
 	// 2. Auth
-	if err := c.authenticate(conn); err != nil {
+	authResp, err := c.authenticate(conn, protocol.ConnTypeControl)
+	if err != nil {
+		c.events.Publish(events.Error, map[string]interface{}{"message": err.Error()})
 		return err
 	}
 	log.Println("Authentication successful")
+	c.events.Publish(events.ClientConnect, map[string]interface{}{
+		"server_addr": c.Config.ServerAddr,
+		"session":     authResp.SessionID,
+	})
 
-	// 3. Register Tunnels
-	for _, t := range c.Config.Tunnels {
-		if err := c.registerTunnel(conn, t); err != nil {
-			log.Printf("Failed to register tunnel %s: %v", t.Name, err)
-			continue // Or return error?
-		}
+	poolCount := c.Config.PoolCount
+	if poolCount > authResp.MaxPoolCount {
+		poolCount = authResp.MaxPoolCount
 	}
+	c.mu.Lock()
+	c.sessionID = authResp.SessionID
+	c.poolCount = poolCount
+	tunnels := append([]config.Tunnel(nil), c.tunnels...)
+	c.mu.Unlock()
+
+	// 3. Register Tunnels, responses are delivered by the command loop below
+	go func() {
+		for _, t := range tunnels {
+			if err := c.registerTunnel(conn, t, false); err != nil {
+				log.Printf("Failed to register tunnel %s: %v", t.Name, err)
+				c.events.Publish(events.Error, map[string]interface{}{
+					"message": fmt.Sprintf("Failed to register tunnel %s: %v", t.Name, err),
+					"tunnel":  t.Name,
+				})
+				continue // Or return error?
+			}
+		}
+	}()
 
-	// 4. Heartbeat & Command Loop
-	go c.heartbeat(conn)
+	// 4. Pool, Heartbeat & Command Loop
+	for i := 0; i < poolCount; i++ {
+		go c.runPoolWorker(authResp.SessionID, done)
+	}
+	interval := time.Duration(authResp.HeartbeatInterval) * time.Second
+	if interval <= 0 {
+		interval = defaultHeartbeatInterval
+	}
+	go c.heartbeat(conn, interval, time.Duration(authResp.HeartbeatTimeout)*time.Second, done)
 
 	decoder := json.NewDecoder(conn)
 	for {
@@ -72,6 +172,7 @@ func (c *Client) Start() error {
 			}
 			return err
 		}
+		atomic.StoreInt64(&c.lastSeen, time.Now().UnixNano())
 
 		switch msg.Type {
 		case protocol.TypeNewConn:
@@ -81,90 +182,214 @@ func (c *Client) Start() error {
 				continue
 			}
 			go c.handleNewConn(req)
+		case protocol.TypeRegResp:
+			var resp protocol.RegTunnelResponse
+			if err := json.Unmarshal(msg.Payload, &resp); err != nil {
+				log.Printf("Invalid reg_resp payload: %v", err)
+				continue
+			}
+			c.deliverRegResp(resp)
+		case protocol.TypePing:
+			// Echo the payload so the server can measure the round-trip time
+			protocol.WriteMessage(conn, protocol.TypePong, msg.Payload)
 		case protocol.TypePong:
-			// log.Println("Pong received")
+			var pong protocol.Ping
+			if err := json.Unmarshal(msg.Payload, &pong); err == nil && pong.Timestamp != 0 {
+				atomic.StoreInt64(&c.rtt, time.Now().UnixNano()-pong.Timestamp)
+			}
 		}
 	}
 }
 
-func (c *Client) authenticate(conn net.Conn) error {
-	req := protocol.AuthRequest{Token: c.Config.Token}
+func (c *Client) authenticate(conn net.Conn, connType string) (*protocol.AuthResponse, error) {
+	req := protocol.AuthRequest{
+		Token:             c.Config.Token,
+		ConnType:          connType,
+		HeartbeatInterval: c.Config.HeartbeatInterval,
+	}
 	if err := protocol.WriteMessage(conn, protocol.TypeAuth, req); err != nil {
-		return err
+		return nil, err
 	}
 
 	var msg protocol.Message
 	decoder := json.NewDecoder(conn)
 	if err := decoder.Decode(&msg); err != nil {
-		return err
+		return nil, err
 	}
 
 	if msg.Type != protocol.TypeAuthResp {
-		return fmt.Errorf("unexpected auth response type: %s", msg.Type)
+		return nil, fmt.Errorf("unexpected auth response type: %s", msg.Type)
 	}
 
 	var resp protocol.AuthResponse
 	if err := json.Unmarshal(msg.Payload, &resp); err != nil {
-		return err
+		return nil, err
 	}
 
 	if !resp.Success {
-		return fmt.Errorf("auth failed: %s", resp.Error)
+		return nil, fmt.Errorf("auth failed: %s", resp.Error)
 	}
-	return nil
+	return &resp, nil
 }
 
-func (c *Client) registerTunnel(conn net.Conn, t config.Tunnel) error {
-	req := protocol.RegTunnelRequest{
-		Name:       t.Name,
-		Protocol:   t.Protocol,
-		RemotePort: t.RemotePort,
+// dialData opens an authenticated data connection to the server.
+func (c *Client) dialData() (net.Conn, error) {
+	conn, err := net.Dial("tcp", c.Config.ServerAddr)
+	if err != nil {
+		return nil, err
 	}
+	if _, err := c.authenticate(conn, protocol.ConnTypeData); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
 
-	if err := protocol.WriteMessage(conn, protocol.TypeRegTunnel, req); err != nil {
-		return err
+// findTunnel returns the current settings of the named tunnel, which the Web UI
+// may have changed since startup, or nil.
+func (c *Client) findTunnel(name string) *config.Tunnel {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if i := c.tunnelIndex(name); i >= 0 {
+		t := c.tunnels[i]
+		return &t
 	}
+	return nil
+}
 
-	// We expect a synchronous response for each registration to ensure it worked
-	var msg protocol.Message
-	decoder := json.NewDecoder(conn)
-	if err := decoder.Decode(&msg); err != nil {
-		return err
+// tunnelIndex returns the position of the named tunnel, or -1. Called with mu held.
+func (c *Client) tunnelIndex(name string) int {
+	for i, t := range c.tunnels {
+		if t.Name == name {
+			return i
+		}
 	}
+	return -1
+}
 
-	if msg.Type != protocol.TypeRegResp {
-		return fmt.Errorf("unexpected reg response type: %s", msg.Type)
+// regRequest returns the settings of t the server applies.
+func regRequest(t config.Tunnel) protocol.RegTunnelRequest {
+	return protocol.RegTunnelRequest{
+		Name:          t.Name,
+		Protocol:      t.Protocol,
+		RemotePort:    t.RemotePort,
+		Compression:   t.CompressionAlgo(),
+		UseEncryption: t.UseEncryption,
+		SecretKey:     t.SecretKey,
+
+		CustomDomains:     t.CustomDomains,
+		Locations:         t.Locations,
+		StripLocation:     t.StripLocation,
+		HostHeaderRewrite: t.HostHeaderRewrite,
+		RequestHeaders:    protocol.HeaderRules(t.RequestHeaders),
+		ResponseHeaders:   protocol.HeaderRules(t.ResponseHeaders),
+		HTTPUser:          t.HTTPUser,
+		HTTPPassword:      t.HTTPPassword,
+		BearerTokens:      t.BearerTokens,
 	}
+}
 
-	var resp protocol.RegTunnelResponse
-	if err := json.Unmarshal(msg.Payload, &resp); err != nil {
-		return err
+// registerTunnel registers t on the server, or with replace set, updates the
+// tunnel of the same name this client registered before.
+func (c *Client) registerTunnel(conn net.Conn, t config.Tunnel, replace bool) error {
+	req := regRequest(t)
+	req.Replace = replace
+	req.ID = atomic.AddUint64(&c.regSeq, 1)
+
+	// We expect a response for each registration to ensure it worked
+	resp, err := c.request(conn, protocol.TypeRegTunnel, req.ID, req)
+	if err != nil {
+		return fmt.Errorf("registration %v", err)
 	}
 
-	if !resp.Success {
-		return fmt.Errorf("registration failed: %s", resp.Error)
+	if replace {
+		log.Printf("Tunnel %s updated on port %d", t.Name, resp.RemotePort)
+	} else {
+		log.Printf("Tunnel %s registered successfully on port %d", t.Name, resp.RemotePort)
 	}
-	
-	log.Printf("Tunnel %s registered successfully on port %d", t.Name, resp.RemotePort)
+	c.events.Publish(events.TunnelRegister, map[string]interface{}{
+		"name":        t.Name,
+		"protocol":    t.Protocol,
+		"remote_port": resp.RemotePort,
+	})
 	return nil
 }
 
-func (c *Client) heartbeat(conn net.Conn) {
-	ticker := time.NewTicker(10 * time.Second)
+// request sends a registration or unregistration with the given ID on the
+// control connection and waits for the control loop to deliver its response.
+func (c *Client) request(conn net.Conn, msgType protocol.MessageType, id uint64, payload interface{}) (protocol.RegTunnelResponse, error) {
+	respCh := make(chan protocol.RegTunnelResponse, 1)
+	c.regMu.Lock()
+	c.pendingRegs[id] = respCh
+	c.regMu.Unlock()
+	defer func() {
+		c.regMu.Lock()
+		delete(c.pendingRegs, id)
+		c.regMu.Unlock()
+	}()
+
+	if err := protocol.WriteMessage(conn, msgType, payload); err != nil {
+		return protocol.RegTunnelResponse{}, err
+	}
+	select {
+	case resp := <-respCh:
+		if !resp.Success {
+			return resp, fmt.Errorf("failed: %s", resp.Error)
+		}
+		return resp, nil
+	case <-time.After(registerTimeout):
+		return protocol.RegTunnelResponse{}, fmt.Errorf("timed out")
+	}
+}
+
+// deliverRegResp hands a response to the request call waiting for it.
+func (c *Client) deliverRegResp(resp protocol.RegTunnelResponse) {
+	c.regMu.Lock()
+	respCh, ok := c.pendingRegs[resp.ID]
+	c.regMu.Unlock()
+	if !ok {
+		log.Printf("Unexpected registration response for tunnel %s", resp.Name)
+		return
+	}
+	select {
+	case respCh <- resp:
+	default:
+	}
+}
+
+// heartbeat pings the server and drops the control connection once the server
+// has been silent for longer than the heartbeat timeout, so Start can reconnect.
+//
+// The timeout is the one negotiated with the server, so both sides give up on
+// each other at the same time, unless the client's own setting is longer.
+func (c *Client) heartbeat(conn net.Conn, interval, negotiated time.Duration, done <-chan struct{}) {
+	timeout := defaultHeartbeatTimeout
+	if c.Config.HeartbeatTimeout > 0 {
+		timeout = time.Duration(c.Config.HeartbeatTimeout) * time.Second
+	}
+	if negotiated > 0 && (c.Config.HeartbeatTimeout <= 0 || timeout < negotiated) {
+		timeout = negotiated
+	}
+	if timeout < 3*interval {
+		timeout = 3 * interval
+	}
+
+	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
 	for {
 		select {
+		case <-done:
+			return
 		case <-ticker.C:
-			c.mu.Lock()
-			currentConn := c.controlConn
-			c.mu.Unlock()
-			
-			if currentConn == nil {
+			lastSeen := time.Unix(0, atomic.LoadInt64(&c.lastSeen))
+			if time.Since(lastSeen) > timeout {
+				log.Printf("No heartbeat from server for %s, reconnecting", timeout)
+				conn.Close()
 				return
 			}
 
-			if err := protocol.WriteMessage(currentConn, protocol.TypePing, nil); err != nil {
+			if err := protocol.WriteMessage(conn, protocol.TypePing, protocol.Ping{Timestamp: time.Now().UnixNano()}); err != nil {
 				log.Printf("Heartbeat failed: %v", err)
 				return
 			}
@@ -173,99 +398,309 @@ func (c *Client) heartbeat(conn net.Conn) {
 }
 
 func (c *Client) handleNewConn(req protocol.NewConnRequest) {
-	// Find local address for this tunnel
-	var localAddr string
-	// We need to look up in the config (which might have changed dynamically)
-	// or we should pass the updated config reference.
-	// Since c.Config is a pointer, and Web UI updates the content of that pointer, we should see the new tunnels here!
-	for _, t := range c.Config.Tunnels {
-		if t.Name == req.TunnelName {
-			localAddr = t.LocalAddr
-			break
-		}
-	}
-
-	if localAddr == "" {
+	tunnel := c.findTunnel(req.TunnelName)
+	if tunnel == nil {
 		log.Printf("Unknown tunnel name: %s", req.TunnelName)
 		return
 	}
 
-	// 1. Dial Local Service
-	localConn, err := net.Dial("tcp", localAddr)
+	// 1. Dial Server Control Port (Data connection)
+	serverConn, err := c.dialData()
 	if err != nil {
-		log.Printf("Failed to dial local service %s: %v", localAddr, err)
+		log.Printf("Failed to open server data conn: %v", err)
 		return
 	}
-	defer localConn.Close()
+	defer serverConn.Close()
 
-	// 2. Dial Server Control Port (Data connection)
-	serverConn, err := net.Dial("tcp", c.Config.ServerAddr)
-	if err != nil {
-		log.Printf("Failed to dial server data conn: %v", err)
+	// 2. Claim the pending public connection
+	proxyReq := protocol.ProxyDataRequest{ConnID: req.ConnID}
+	if err := protocol.WriteMessage(serverConn, protocol.TypeProxyData, proxyReq); err != nil {
+		log.Printf("Data conn proxy req failed: %v", err)
 		return
 	}
-	defer serverConn.Close()
 
-	// 3. Handshake as Proxy Data
-	authReq := protocol.AuthRequest{Token: c.Config.Token}
-	if err := protocol.WriteMessage(serverConn, protocol.TypeAuth, authReq); err != nil {
-		log.Printf("Data conn auth write failed: %v", err)
+	c.handleWorkConn(*tunnel, req.ConnID, serverConn)
+}
+
+// handleWorkConn serves a data connection that the server has bound to a public connection.
+func (c *Client) handleWorkConn(tunnel config.Tunnel, connID string, serverConn net.Conn) {
+	stats := c.tunnelTraffic(tunnel.Name)
+	atomic.AddInt64(&stats.ActiveConns, 1)
+	tracked := c.conns.Add(api.Connection{ID: connID, Tunnel: tunnel.Name, StartTime: time.Now(), State: api.ConnActive}, serverConn)
+	c.events.Publish(events.ConnOpen, map[string]interface{}{"conn_id": connID, "tunnel": tunnel.Name})
+	defer func() {
+		atomic.AddInt64(&stats.ActiveConns, -1)
+		c.conns.Remove(connID)
+		c.events.Publish(events.ConnClose, map[string]interface{}{"conn_id": connID, "tunnel": tunnel.Name})
+	}()
+	serverConn = transport.CountBytes(tracked.Count(serverConn), &stats.BytesIn, &stats.BytesOut)
+	limitIn, limitOut := c.limiters(tunnel, false)
+	serverConn = transport.Limit(serverConn, limitIn, limitOut)
+
+	// Wrap the data stream as negotiated at registration
+	dataConn, err := transport.Wrap(serverConn, transport.Options{
+		Compression: tunnel.CompressionAlgo(),
+		Encryption:  tunnel.UseEncryption,
+		Token:       c.Config.Token,
+		ConnID:      connID,
+		IsClient:    true,
+	})
+	if err != nil {
+		log.Printf("Failed to set up data stream %s: %v", connID, err)
 		return
 	}
-	
-	// Read Auth Resp
-	var msg protocol.Message
-	if err := json.NewDecoder(serverConn).Decode(&msg); err != nil {
-		log.Printf("Data conn auth read failed: %v", err)
+	defer dataConn.Close()
+
+	// Plugins serve the connection themselves
+	if tunnel.Plugin != "" {
+		p, err := plugin.New(tunnel)
+		if err != nil {
+			log.Printf("Tunnel %s plugin error: %v", tunnel.Name, err)
+			return
+		}
+		p.Handle(dataConn)
 		return
 	}
 
-	proxyReq := protocol.ProxyDataRequest{ConnID: req.ConnID}
-	if err := protocol.WriteMessage(serverConn, protocol.TypeProxyData, proxyReq); err != nil {
-		log.Printf("Data conn proxy req failed: %v", err)
+	if tunnel.Inspect && tunnel.Protocol == "http" {
+		c.serveInspected(tunnel, dataConn)
 		return
 	}
 
-	// 4. Bridge
-	go io.Copy(localConn, serverConn)
-	io.Copy(serverConn, localConn)
+	// Dial Local Service
+	localConn, err := dialLocal(tunnel)
+	if err != nil {
+		log.Printf("Failed to dial local service %s: %v", tunnel.LocalAddr, err)
+		c.events.Publish(events.Error, map[string]interface{}{
+			"message": fmt.Sprintf("Failed to dial local service %s: %v", tunnel.LocalAddr, err),
+			"tunnel":  tunnel.Name,
+		})
+		return
+	}
+	defer localConn.Close()
+
+	// Bridge
+	transport.Join(localConn, dataConn)
+}
+
+// tunnelTraffic returns the counters of the named tunnel, creating them on first use.
+func (c *Client) tunnelTraffic(name string) *tunnelTraffic {
+	c.trafficMu.Lock()
+	defer c.trafficMu.Unlock()
+	stats, ok := c.traffic[name]
+	if !ok {
+		stats = &tunnelTraffic{}
+		c.traffic[name] = stats
+	}
+	return stats
+}
+
+// limiters returns the bandwidth limiters of tunnel t, created with its limit on
+// first use. With update set, the limit of t also applies to the connections
+// already open.
+func (c *Client) limiters(t config.Tunnel, update bool) (in, out *transport.Limiter) {
+	stats := c.tunnelTraffic(t.Name)
+	rate := int64(t.BandwidthLimit) * 1024
+	c.trafficMu.Lock()
+	defer c.trafficMu.Unlock()
+	if stats.limitIn == nil {
+		stats.limitIn = transport.NewLimiter(rate)
+		stats.limitOut = transport.NewLimiter(rate)
+	} else if update {
+		stats.limitIn.SetRate(rate)
+		stats.limitOut.SetRate(rate)
+	}
+	return stats.limitIn, stats.limitOut
+}
+
+// trafficSnapshot reads the byte counters of every configured tunnel.
+func (c *Client) trafficSnapshot() []events.TunnelTraffic {
+	c.mu.Lock()
+	names := make([]string, 0, len(c.tunnels))
+	for _, t := range c.tunnels {
+		names = append(names, t.Name)
+	}
+	c.mu.Unlock()
+
+	samples := make([]events.TunnelTraffic, 0, len(names))
+	for _, name := range names {
+		stats := c.tunnelTraffic(name)
+		samples = append(samples, events.TunnelTraffic{
+			Name:        name,
+			BytesIn:     atomic.LoadInt64(&stats.BytesIn),
+			BytesOut:    atomic.LoadInt64(&stats.BytesOut),
+			ActiveConns: atomic.LoadInt64(&stats.ActiveConns),
+		})
+	}
+	return samples
 }
 
 func (c *Client) GetStatus() interface{} {
+	traffic := c.trafficSnapshot()
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	var lastHeartbeat interface{}
+	if c.connected {
+		lastHeartbeat = time.Unix(0, atomic.LoadInt64(&c.lastSeen))
+	}
 	return map[string]interface{}{
-		"mode": "client",
-		"server_addr": c.Config.ServerAddr,
-		"connected": c.connected,
-		"tunnels": c.Config.Tunnels,
+		"mode":           "client",
+		"server_addr":    c.Config.ServerAddr,
+		"connected":      c.connected,
+		"session_id":     c.sessionID,
+		"pool_count":     c.poolCount,
+		"rtt_ms":         float64(time.Duration(atomic.LoadInt64(&c.rtt)).Microseconds()) / 1000,
+		"last_heartbeat": lastHeartbeat,
+		"tunnels":        config.RedactTunnels(c.tunnels),
+		"visitors":       config.RedactVisitors(c.Config.Visitors),
+		"traffic":        traffic,
 	}
 }
 
-func (c *Client) AddTunnel(t config.Tunnel) error {
+func (c *Client) Tunnels() []api.Tunnel {
+	c.mu.Lock()
+	configured := append([]config.Tunnel(nil), c.tunnels...)
+	c.mu.Unlock()
+
+	tunnels := make([]api.Tunnel, 0, len(configured))
+	for _, t := range configured {
+		stats := c.tunnelTraffic(t.Name)
+		redacted := t.Redacted()
+		tunnels = append(tunnels, api.Tunnel{
+			Name:          t.Name,
+			Protocol:      t.Protocol,
+			RemotePort:    t.RemotePort,
+			CustomDomains: t.CustomDomains,
+			Locations:     t.Locations,
+			Compression:   t.CompressionAlgo(),
+			UseEncryption: t.UseEncryption,
+			ActiveConns:   atomic.LoadInt64(&stats.ActiveConns),
+			BytesIn:       atomic.LoadInt64(&stats.BytesIn),
+			BytesOut:      atomic.LoadInt64(&stats.BytesOut),
+			Config:        &redacted,
+		})
+	}
+	return tunnels
+}
+
+// Sessions returns the control connection to the server, if there is one.
+func (c *Client) Sessions() []api.Session {
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	if !c.connected || c.sessionID == "" {
+		return []api.Session{}
+	}
+	tunnels := make([]string, 0, len(c.tunnels))
+	for _, t := range c.tunnels {
+		tunnels = append(tunnels, t.Name)
+	}
+	return []api.Session{{
+		ID:         c.sessionID,
+		RemoteAddr: c.Config.ServerAddr,
+		StartTime:  c.startTime,
+		LastSeen:   time.Unix(0, atomic.LoadInt64(&c.lastSeen)),
+		RTTMs:      float64(time.Duration(atomic.LoadInt64(&c.rtt)).Microseconds()) / 1000,
+		PoolIdle:   int(atomic.LoadInt64(&c.poolIdle)),
+		Tunnels:    tunnels,
+	}}
+}
+
+func (c *Client) Connections() []api.Connection {
+	return c.conns.List()
+}
+
+// KillConnection closes a data connection, which also ends its public
+// connection on the server.
+func (c *Client) KillConnection(id string) error {
+	info, err := c.conns.Kill(id)
+	if err != nil {
+		return err
+	}
+	log.Printf("Connection %s on %s killed", id, info.Tunnel)
+	return nil
+}
 
+// AddTunnel adds a tunnel, registering it right away when connected.
+func (c *Client) AddTunnel(t config.Tunnel) error {
+	c.mu.Lock()
 	// Check duplicate name
-	for _, existing := range c.Config.Tunnels {
-		if existing.Name == t.Name {
-			return fmt.Errorf("tunnel name %s already exists", t.Name)
+	if c.tunnelIndex(t.Name) >= 0 {
+		c.mu.Unlock()
+		return fmt.Errorf("tunnel name %s already exists", t.Name)
+	}
+	// Added before registering, so connections the server sends right away are known
+	c.tunnels = append(c.tunnels, t)
+	conn := c.controlConn
+	c.mu.Unlock()
+
+	// If connected, register immediately. The lock is not held while waiting
+	// for the server, status reads and reconnects go on meanwhile.
+	if conn != nil {
+		if err := c.registerTunnel(conn, t, false); err != nil {
+			c.dropTunnel(t.Name)
+			return err
 		}
 	}
+	return nil
+}
 
-	// If connected, register immediately
-	if c.connected && c.controlConn != nil {
-		if err := c.registerTunnel(c.controlConn, t); err != nil {
+// UpdateTunnel applies new settings to a tunnel. Local settings such as local_addr
+// are read for every new connection and apply to the ones after the update, the
+// bandwidth limit applies to open connections too. When the
+// settings the server enforces change, the server replaces the tunnel in place,
+// keeping its public port open unless remote_port changes.
+func (c *Client) UpdateTunnel(t config.Tunnel) error {
+	old := c.findTunnel(t.Name)
+	c.mu.Lock()
+	conn := c.controlConn
+	c.mu.Unlock()
+
+	if old == nil {
+		return fmt.Errorf("tunnel %s not found", t.Name)
+	}
+	if conn != nil && !reflect.DeepEqual(regRequest(*old), regRequest(t)) {
+		if err := c.registerTunnel(conn, t, true); err != nil {
 			return err
 		}
 	}
-	
-	// Note: We don't update c.Config.Tunnels here because the Web handler does it.
+	c.limiters(t, true)
+	c.mu.Lock()
+	if i := c.tunnelIndex(t.Name); i >= 0 {
+		c.tunnels[i] = t
+	}
+	c.mu.Unlock()
 	return nil
 }
 
+// RemoveTunnel releases a tunnel on the server, closing its public port, and
+// forgets it, so it is not registered again on reconnect.
 func (c *Client) RemoveTunnel(name string) error {
-	// Not fully implemented on protocol level (can't unregister on server yet),
-	// but we can allow removing from client config so it doesn't reconnect.
+	c.mu.Lock()
+	conn := c.controlConn
+	c.mu.Unlock()
+
+	if conn != nil {
+		req := protocol.UnregTunnelRequest{ID: atomic.AddUint64(&c.regSeq, 1), Name: name}
+		if _, err := c.request(conn, protocol.TypeUnregTunnel, req.ID, req); err != nil {
+			return fmt.Errorf("unregistration %v", err)
+		}
+		log.Printf("Tunnel %s unregistered", name)
+		c.events.Publish(events.TunnelUnregister, map[string]interface{}{"name": name})
+	}
+	c.dropTunnel(name)
 	return nil
-}
\ No newline at end of file
+}
+
+// dropTunnel forgets the named tunnel along with its counters and bandwidth
+// limiters, a tunnel added later under the same name starts afresh.
+func (c *Client) dropTunnel(name string) {
+	c.mu.Lock()
+	if i := c.tunnelIndex(name); i >= 0 {
+		c.tunnels = append(c.tunnels[:i:i], c.tunnels[i+1:]...)
+	}
+	c.mu.Unlock()
+
+	c.trafficMu.Lock()
+	delete(c.traffic, name)
+	c.trafficMu.Unlock()
+}
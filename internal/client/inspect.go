@@ -0,0 +1,326 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"sync"
+	"time"
+
+	"openproxy/internal/config"
+	"openproxy/internal/transport"
+)
+
+const (
+	defaultInspectLimit     = 100
+	defaultInspectBodyLimit = 64 * 1024
+)
+
+// Headers of one connection, not sent again when a request is replayed.
+// Content-Length is set from the captured body.
+var hopHeaders = []string{
+	"Connection", "Keep-Alive", "Proxy-Connection", "Proxy-Authenticate", "Proxy-Authorization",
+	"Te", "Trailer", "Transfer-Encoding", "Upgrade", "Content-Length",
+}
+
+// InspectRecord is a captured request/response pair of an inspected HTTP tunnel.
+type InspectRecord struct {
+	ID                uint64      `json:"id"`
+	Tunnel            string      `json:"tunnel"`
+	Time              time.Time   `json:"time"`
+	DurationMs        float64     `json:"duration_ms"`
+	RemoteAddr        string      `json:"remote_addr"` // Public client, as reported by the server
+	Method            string      `json:"method"`
+	Host              string      `json:"host"`
+	URL               string      `json:"url"` // Request URI
+	Proto             string      `json:"proto"`
+	RequestHeaders    http.Header `json:"request_headers"`
+	RequestBody       string      `json:"request_body"`
+	RequestTruncated  bool        `json:"request_truncated,omitempty"` // Longer than the limit, or not read to the end
+	Status            int         `json:"status"`
+	ResponseHeaders   http.Header `json:"response_headers"`
+	ResponseBody      string      `json:"response_body"`
+	ResponseTruncated bool        `json:"response_truncated,omitempty"`
+	Error             string      `json:"error,omitempty"`
+	ReplayOf          uint64      `json:"replay_of,omitempty"` // ID of the replayed record
+
+	requestBody []byte
+}
+
+// inspector keeps the most recent records in a ring buffer.
+type inspector struct {
+	mu        sync.Mutex
+	records   []*InspectRecord
+	next      int // Slot overwritten once the buffer is full
+	seq       uint64
+	limit     int
+	bodyLimit int
+}
+
+func newInspector(limit, bodyLimit int) *inspector {
+	if limit <= 0 {
+		limit = defaultInspectLimit
+	}
+	if bodyLimit <= 0 {
+		bodyLimit = defaultInspectBodyLimit
+	}
+	return &inspector{limit: limit, bodyLimit: bodyLimit}
+}
+
+func (in *inspector) add(rec *InspectRecord) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.seq++
+	rec.ID = in.seq
+	if len(in.records) < in.limit {
+		in.records = append(in.records, rec)
+		return
+	}
+	in.records[in.next] = rec
+	in.next = (in.next + 1) % in.limit
+}
+
+// list returns the records of tunnel, or of all tunnels if it is empty, newest first.
+func (in *inspector) list(tunnel string) []*InspectRecord {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	out := make([]*InspectRecord, 0, len(in.records))
+	for i := len(in.records) - 1; i >= 0; i-- {
+		rec := in.records[(in.next+i)%len(in.records)]
+		if tunnel == "" || rec.Tunnel == tunnel {
+			out = append(out, rec)
+		}
+	}
+	return out
+}
+
+func (in *inspector) get(id uint64) *InspectRecord {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	for _, rec := range in.records {
+		if rec.ID == id {
+			return rec
+		}
+	}
+	return nil
+}
+
+// limitedBuffer keeps the first max bytes written to it and notes whether more followed.
+type limitedBuffer struct {
+	bytes.Buffer
+	max       int
+	truncated bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	room := b.max - b.Len()
+	if len(p) > room {
+		b.truncated = true
+		if room > 0 {
+			b.Buffer.Write(p[:room])
+		}
+		return len(p), nil
+	}
+	return b.Buffer.Write(p)
+}
+
+// captureBody copies what the proxy reads from the request body.
+type captureBody struct {
+	io.ReadCloser
+	buf *limitedBuffer
+	eof bool // The whole body was read
+}
+
+func (b *captureBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.buf.Write(p[:n])
+	if err == io.EOF {
+		b.eof = true
+	}
+	return n, err
+}
+
+// captureResponseWriter records the status, headers and body sent back through the tunnel.
+type captureResponseWriter struct {
+	http.ResponseWriter
+	status  int
+	headers http.Header
+	body    *limitedBuffer
+	err     error
+}
+
+func (w *captureResponseWriter) WriteHeader(status int) {
+	if w.headers == nil {
+		w.status = status
+		w.headers = w.Header().Clone()
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *captureResponseWriter) Write(p []byte) (int, error) {
+	if w.headers == nil {
+		w.WriteHeader(http.StatusOK)
+	}
+	w.body.Write(p)
+	return w.ResponseWriter.Write(p)
+}
+
+// Unwrap lets the reverse proxy flush and hijack the underlying connection.
+func (w *captureResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// localHTTPTransport sends requests to the local service of t.
+func localHTTPTransport(t config.Tunnel) *http.Transport {
+	return &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialLocal(t)
+		},
+		DisableCompression:    true,
+		ResponseHeaderTimeout: 60 * time.Second,
+	}
+}
+
+// serveInspected proxies the HTTP requests of a work connection to the local
+// service of t, recording every exchange.
+func (c *Client) serveInspected(t config.Tunnel, conn net.Conn) {
+	tr := localHTTPTransport(t)
+	defer tr.CloseIdleConnections()
+
+	proxy := &httputil.ReverseProxy{
+		Transport: tr,
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.Out.URL.Scheme = "http"
+			pr.Out.URL.Host = pr.In.Host
+			pr.Out.Host = pr.In.Host
+			// The server already set the forwarding headers, keep them as they are
+			for _, h := range []string{"X-Forwarded-For", "X-Forwarded-Host", "X-Forwarded-Proto"} {
+				if v, ok := pr.In.Header[h]; ok {
+					pr.Out.Header[h] = v
+				}
+			}
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			if cw, ok := w.(*captureResponseWriter); ok {
+				cw.err = err
+			}
+			log.Printf("Tunnel %s failed to reach local service: %v", t.Name, err)
+			http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		},
+	}
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := newInspectRecord(t.Name, r)
+		reqBody := &limitedBuffer{max: c.inspector.bodyLimit}
+		var capture *captureBody
+		if r.Body != nil && r.Body != http.NoBody {
+			capture = &captureBody{ReadCloser: r.Body, buf: reqBody}
+			r.Body = capture
+		}
+		cw := &captureResponseWriter{ResponseWriter: w, body: &limitedBuffer{max: c.inspector.bodyLimit}}
+
+		proxy.ServeHTTP(cw, r)
+
+		rec.DurationMs = float64(time.Since(rec.Time).Microseconds()) / 1000
+		rec.requestBody = reqBody.Bytes()
+		rec.RequestBody = reqBody.String()
+		// A body the proxy stopped reading, say when the local service was down, is incomplete too
+		rec.RequestTruncated = reqBody.truncated || capture != nil && !capture.eof
+		rec.Status = cw.status
+		rec.ResponseHeaders = cw.headers
+		rec.ResponseBody = cw.body.String()
+		rec.ResponseTruncated = cw.body.truncated
+		if cw.err != nil {
+			rec.Error = cw.err.Error()
+		}
+		c.inspector.add(rec)
+	})
+
+	transport.ServeHTTP(conn, handler)
+}
+
+func newInspectRecord(tunnel string, r *http.Request) *InspectRecord {
+	remote := r.Header.Get("X-Real-IP")
+	if remote == "" {
+		remote = r.RemoteAddr
+	}
+	return &InspectRecord{
+		Tunnel:         tunnel,
+		Time:           time.Now(),
+		RemoteAddr:     remote,
+		Method:         r.Method,
+		Host:           r.Host,
+		URL:            r.RequestURI,
+		Proto:          r.Proto,
+		RequestHeaders: r.Header.Clone(),
+	}
+}
+
+// GetInspections returns the captured requests of tunnel, or of all tunnels, newest first.
+func (c *Client) GetInspections(tunnel string) (interface{}, error) {
+	return c.inspector.list(tunnel), nil
+}
+
+// ReplayRequest resends a captured request to the local service of its tunnel
+// and records the result as a new entry.
+func (c *Client) ReplayRequest(id uint64) (interface{}, error) {
+	orig := c.inspector.get(id)
+	if orig == nil {
+		return nil, fmt.Errorf("request %d not found", id)
+	}
+	if orig.RequestTruncated {
+		return nil, fmt.Errorf("request %d body was not captured in full, cannot replay", id)
+	}
+	t := c.findTunnel(orig.Tunnel)
+	if t == nil {
+		return nil, fmt.Errorf("tunnel %s not found", orig.Tunnel)
+	}
+
+	req, err := http.NewRequest(orig.Method, "http://"+orig.Host+orig.URL, bytes.NewReader(orig.requestBody))
+	if err != nil {
+		return nil, err
+	}
+	req.Header = orig.RequestHeaders.Clone()
+	for _, f := range req.Header.Values("Connection") {
+		for _, name := range strings.Split(f, ",") {
+			req.Header.Del(strings.TrimSpace(name))
+		}
+	}
+	for _, h := range hopHeaders {
+		req.Header.Del(h)
+	}
+	req.Host = orig.Host
+
+	rec := newInspectRecord(orig.Tunnel, req)
+	rec.URL = orig.URL
+	rec.Proto = orig.Proto
+	rec.RemoteAddr = orig.RemoteAddr
+	rec.ReplayOf = id
+	rec.requestBody = orig.requestBody
+	rec.RequestBody = orig.RequestBody
+
+	tr := localHTTPTransport(*t)
+	defer tr.CloseIdleConnections()
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		rec.Status = http.StatusBadGateway
+		rec.Error = err.Error()
+	} else {
+		body := &limitedBuffer{max: c.inspector.bodyLimit}
+		io.Copy(body, resp.Body)
+		resp.Body.Close()
+		rec.Status = resp.StatusCode
+		rec.ResponseHeaders = resp.Header
+		rec.ResponseBody = body.String()
+		rec.ResponseTruncated = body.truncated
+	}
+	rec.DurationMs = float64(time.Since(rec.Time).Microseconds()) / 1000
+	c.inspector.add(rec)
+	return rec, nil
+}
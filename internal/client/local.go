@@ -0,0 +1,119 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"openproxy/internal/config"
+)
+
+const localTLSHandshakeTimeout = 10 * time.Second
+
+// localTLSConfigs holds the TLS config built for each tunnel, so the CA and key
+// files are not read again on every connection.
+var (
+	localTLSConfigs   = make(map[string]localTLSEntry)
+	localTLSConfigsMu sync.Mutex
+)
+
+type localTLSEntry struct {
+	key    string // Settings and file versions the config was built from
+	config *tls.Config
+}
+
+// dialLocal connects to the tunnel's local service over TCP or a Unix socket,
+// optionally speaking TLS to it. Everything that reaches a local service goes through here.
+func dialLocal(t config.Tunnel) (net.Conn, error) {
+	network, addr := t.LocalTarget()
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if !t.LocalTLS {
+		return conn, nil
+	}
+
+	tlsConfig, err := cachedLocalTLSConfig(t, network, addr)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	tlsConn := tls.Client(conn, tlsConfig)
+	ctx, cancel := context.WithTimeout(context.Background(), localTLSHandshakeTimeout)
+	defer cancel()
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("local TLS handshake: %w", err)
+	}
+	return tlsConn, nil
+}
+
+// cachedLocalTLSConfig returns the TLS config of t, built again when its settings
+// change or one of its files is modified.
+func cachedLocalTLSConfig(t config.Tunnel, network, addr string) (*tls.Config, error) {
+	key := fmt.Sprintf("%s|%s|%s|%t", network, addr, t.LocalTLSServerName, t.LocalTLSInsecureSkipVerify)
+	for _, path := range []string{t.LocalTLSCAFile, t.LocalTLSCertFile, t.LocalTLSKeyFile} {
+		key += "|" + path
+		if path == "" {
+			continue
+		}
+		if info, err := os.Stat(path); err == nil {
+			key += fmt.Sprintf("@%d/%d", info.ModTime().UnixNano(), info.Size())
+		}
+	}
+
+	localTLSConfigsMu.Lock()
+	entry, ok := localTLSConfigs[t.Name]
+	localTLSConfigsMu.Unlock()
+	if ok && entry.key == key {
+		return entry.config, nil
+	}
+
+	cfg, err := localTLSConfig(t, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	localTLSConfigsMu.Lock()
+	localTLSConfigs[t.Name] = localTLSEntry{key: key, config: cfg}
+	localTLSConfigsMu.Unlock()
+	return cfg, nil
+}
+
+func localTLSConfig(t config.Tunnel, network, addr string) (*tls.Config, error) {
+	cfg := &tls.Config{
+		ServerName:         t.LocalTLSServerName,
+		InsecureSkipVerify: t.LocalTLSInsecureSkipVerify,
+	}
+	if cfg.ServerName == "" && network == "tcp" {
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			cfg.ServerName = host
+		}
+	}
+
+	if t.LocalTLSCAFile != "" {
+		pem, err := os.ReadFile(t.LocalTLSCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", t.LocalTLSCAFile)
+		}
+		cfg.RootCAs = pool
+	}
+
+	if t.LocalTLSCertFile != "" || t.LocalTLSKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.LocalTLSCertFile, t.LocalTLSKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
@@ -0,0 +1,85 @@
+package client
+
+import (
+	"encoding/json"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"openproxy/internal/protocol"
+	"openproxy/internal/transport"
+)
+
+// runPoolWorker keeps one idle data connection parked on the server for the session.
+// As soon as the server binds it to a public connection, a replacement is opened.
+func (c *Client) runPoolWorker(sessionID string, done <-chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+
+		conn, err := c.dialData()
+		if err != nil {
+			log.Printf("Failed to open pooled connection: %v", err)
+			if !sleepOrDone(5*time.Second, done) {
+				return
+			}
+			continue
+		}
+
+		if err := protocol.WriteMessage(conn, protocol.TypePoolConn, protocol.PoolConnRequest{SessionID: sessionID}); err != nil {
+			conn.Close()
+			if !sleepOrDone(time.Second, done) {
+				return
+			}
+			continue
+		}
+
+		// Wait until the server hands us a public connection
+		atomic.AddInt64(&c.poolIdle, 1)
+		decoder := json.NewDecoder(conn)
+		var msg protocol.Message
+		err = decoder.Decode(&msg)
+		atomic.AddInt64(&c.poolIdle, -1)
+		if err != nil {
+			// The server drops pooled connections when the session ends or the pool is full
+			conn.Close()
+			if !sleepOrDone(time.Second, done) {
+				return
+			}
+			continue
+		}
+
+		var req protocol.NewConnRequest
+		if msg.Type != protocol.TypeStartWork || json.Unmarshal(msg.Payload, &req) != nil {
+			log.Printf("Unexpected message on pooled connection: %s", msg.Type)
+			conn.Close()
+			continue
+		}
+
+		tunnel := c.findTunnel(req.TunnelName)
+		if tunnel == nil {
+			log.Printf("Unknown tunnel name: %s", req.TunnelName)
+			conn.Close()
+			continue
+		}
+
+		workConn := transport.AfterMessages(conn, decoder)
+		go func() {
+			defer workConn.Close()
+			c.handleWorkConn(*tunnel, req.ConnID, workConn)
+		}()
+	}
+}
+
+// sleepOrDone waits for d and reports false if done was closed first.
+func sleepOrDone(d time.Duration, done <-chan struct{}) bool {
+	select {
+	case <-done:
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
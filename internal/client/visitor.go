@@ -0,0 +1,105 @@
+package client
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"time"
+
+	"openproxy/internal/config"
+	"openproxy/internal/protocol"
+	"openproxy/internal/transport"
+)
+
+// startVisitors opens the local listeners of all configured visitors.
+// They outlive reconnects of the control connection, so it only runs once.
+func (c *Client) startVisitors() {
+	for _, v := range c.Config.Visitors {
+		bindAddr := v.BindAddr
+		if bindAddr == "" {
+			bindAddr = "127.0.0.1"
+		}
+		addr := net.JoinHostPort(bindAddr, fmt.Sprintf("%d", v.BindPort))
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			log.Printf("Visitor %s failed to listen on %s: %v", v.Name, addr, err)
+			continue
+		}
+		log.Printf("Visitor %s listening on %s for secret tunnel %s", v.Name, addr, v.ServerName)
+		go c.acceptVisitorConnections(v, ln)
+	}
+}
+
+func (c *Client) acceptVisitorConnections(v config.Visitor, ln net.Listener) {
+	defer ln.Close()
+	for {
+		userConn, err := ln.Accept()
+		if err != nil {
+			log.Printf("Visitor %s accept error: %v", v.Name, err)
+			return
+		}
+		go c.handleVisitorConn(v, userConn)
+	}
+}
+
+func (c *Client) handleVisitorConn(v config.Visitor, userConn net.Conn) {
+	defer userConn.Close()
+
+	serverConn, err := c.dialData()
+	if err != nil {
+		log.Printf("Visitor %s failed to open server data conn: %v", v.Name, err)
+		return
+	}
+	defer serverConn.Close()
+
+	ts := time.Now().Unix()
+	b := make([]byte, 16)
+	rand.Read(b)
+	nonce := hex.EncodeToString(b)
+	req := protocol.VisitorRequest{
+		ServerName: v.ServerName,
+		Timestamp:  ts,
+		Nonce:      nonce,
+		Signature:  protocol.SignVisitor(v.SecretKey, v.ServerName, ts, nonce),
+	}
+	if err := protocol.WriteMessage(serverConn, protocol.TypeVisitor, req); err != nil {
+		log.Printf("Visitor %s request failed: %v", v.Name, err)
+		return
+	}
+
+	decoder := json.NewDecoder(serverConn)
+	var msg protocol.Message
+	if err := decoder.Decode(&msg); err != nil {
+		log.Printf("Visitor %s response read failed: %v", v.Name, err)
+		return
+	}
+	var resp protocol.VisitorResponse
+	if msg.Type != protocol.TypeVisitorResp || json.Unmarshal(msg.Payload, &resp) != nil {
+		log.Printf("Visitor %s got unexpected response type: %s", v.Name, msg.Type)
+		return
+	}
+	if !resp.Success {
+		log.Printf("Visitor %s rejected by server: %s", v.Name, resp.Error)
+		return
+	}
+
+	// Wrapped like the tunnel's data streams, keyed with the secret key
+	dataConn, err := transport.Wrap(transport.AfterMessages(serverConn, decoder), transport.Options{
+		Compression: resp.Compression,
+		Encryption:  resp.UseEncryption,
+		Token:       v.SecretKey,
+		ConnID:      protocol.VisitorStreamID(nonce),
+		IsClient:    true,
+	})
+	if err != nil {
+		log.Printf("Visitor %s failed to set up data stream: %v", v.Name, err)
+		return
+	}
+	defer dataConn.Close()
+	go io.Copy(userConn, dataConn)
+	io.Copy(dataConn, userConn)
+}
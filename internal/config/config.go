@@ -3,6 +3,8 @@ package config
 import (
 	"fmt"
 	"os"
+	"strings"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
@@ -12,31 +14,296 @@ type Config struct {
 	Web    WebConfig    `yaml:"web" json:"web"`
 	Server ServerConfig `yaml:"server" json:"server"`
 	Client ClientConfig `yaml:"client" json:"client"`
+	Audit  AuditConfig  `yaml:"audit,omitempty" json:"audit,omitempty"`
+}
+
+// AuditConfig controls the log of administrative actions and security events.
+type AuditConfig struct {
+	Disabled   bool   `yaml:"disabled,omitempty" json:"disabled,omitempty"`
+	Path       string `yaml:"path,omitempty" json:"path,omitempty"`               // JSON lines file (default "audit.log")
+	MaxSize    int    `yaml:"max_size,omitempty" json:"max_size,omitempty"`       // MiB before the file is rotated (default 100)
+	MaxBackups int    `yaml:"max_backups,omitempty" json:"max_backups,omitempty"` // Rotated files kept as path.1, path.2... (default 5)
 }
 
 type WebConfig struct {
-	Port     int    `yaml:"port" json:"port"`
-	Username string `yaml:"username" json:"username"`
-	Password string `yaml:"password" json:"password"`
+	Port           int           `yaml:"port" json:"port"`
+	Username       string        `yaml:"username,omitempty" json:"username,omitempty"`               // Single admin, only used when users is empty
+	Password       string        `yaml:"password,omitempty" json:"password,omitempty"`               // Password hash, or plain text for older configs
+	Users          []WebUser     `yaml:"users,omitempty" json:"users,omitempty"`                     // Dashboard accounts
+	SessionSecret  string        `yaml:"session_secret,omitempty" json:"session_secret,omitempty"`   // Key signing session cookies, random per start if empty
+	SessionTTL     int           `yaml:"session_ttl,omitempty" json:"session_ttl,omitempty"`         // Seconds a login stays valid (default 12h)
+	APITokens      []APIToken    `yaml:"api_tokens,omitempty" json:"api_tokens,omitempty"`           // Created in the dashboard
+	History        HistoryConfig `yaml:"history,omitempty" json:"history,omitempty"`                 // Traffic history for the dashboard charts
+	ConfigVersions int           `yaml:"config_versions,omitempty" json:"config_versions,omitempty"` // Earlier versions of the config file kept on save (default 20, -1 keeps none)
+}
+
+// HistoryConfig controls the traffic history kept on disk for the dashboard charts.
+type HistoryConfig struct {
+	Disabled    bool   `yaml:"disabled,omitempty" json:"disabled,omitempty"`
+	Dir         string `yaml:"dir,omitempty" json:"dir,omitempty"`                   // Where the history is stored (default "metrics")
+	Retention1m int    `yaml:"retention_1m,omitempty" json:"retention_1m,omitempty"` // Days per-minute samples are kept (default 2)
+	Retention1h int    `yaml:"retention_1h,omitempty" json:"retention_1h,omitempty"` // Days hourly samples are kept (default 90)
+	Retention1d int    `yaml:"retention_1d,omitempty" json:"retention_1d,omitempty"` // Days daily samples are kept (default 730)
+}
+
+// Dashboard roles, from most to least privileged
+const (
+	RoleAdmin    = "admin"
+	RoleOperator = "operator"
+	RoleViewer   = "viewer"
+)
+
+// API token scopes, each grants one group of endpoints
+const (
+	ScopeStatusRead   = "status:read"
+	ScopeTunnelsWrite = "tunnels:write"
+	ScopeInspect      = "inspect"
+	ScopeConfigRead   = "config:read"
+	ScopeConfigWrite  = "config:write"
+	ScopeAuditRead    = "audit:read"
+)
+
+var Scopes = []string{ScopeStatusRead, ScopeTunnelsWrite, ScopeInspect, ScopeConfigRead, ScopeConfigWrite, ScopeAuditRead}
+
+// APIToken lets automation call the web API with "Authorization: Bearer".
+// Personal tokens act as their user, service tokens have a role of their own.
+type APIToken struct {
+	ID        string     `yaml:"id" json:"id"` // Public part of the token, used to find it
+	Name      string     `yaml:"name" json:"name"`
+	Hash      string     `yaml:"hash" json:"hash,omitempty"`           // SHA-256 of the token, the token itself is not stored
+	User      string     `yaml:"user,omitempty" json:"user,omitempty"` // Owner of a personal token, empty for service tokens
+	Role      string     `yaml:"role,omitempty" json:"role,omitempty"` // Role of a service token
+	Scopes    []string   `yaml:"scopes" json:"scopes"`
+	CreatedBy string     `yaml:"created_by" json:"created_by"`
+	CreatedAt time.Time  `yaml:"created_at" json:"created_at"`
+	ExpiresAt *time.Time `yaml:"expires_at,omitempty" json:"expires_at,omitempty"` // Never expires if nil
+}
+
+// Expired reports whether the token can no longer be used.
+func (t APIToken) Expired() bool {
+	return t.ExpiresAt != nil && !time.Now().Before(*t.ExpiresAt)
+}
+
+// HasScope reports whether the token was granted scope.
+func (t APIToken) HasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+type WebUser struct {
+	Username     string `yaml:"username" json:"username"`
+	PasswordHash string `yaml:"password_hash" json:"password_hash"` // bcrypt or argon2id, see "openproxy hash-password"
+	Role         string `yaml:"role" json:"role"`                   // admin, operator or viewer
 }
 
 type ServerConfig struct {
-	ControlPort int    `yaml:"control_port" json:"control_port"`
-	Token       string `yaml:"token" json:"token"`
-	PortRange   string `yaml:"port_range" json:"port_range"` // e.g. "10000-20000"
+	ControlPort      int    `yaml:"control_port" json:"control_port"`
+	Token            string `yaml:"token" json:"token"`
+	PortRange        string `yaml:"port_range" json:"port_range"`                                   // e.g. "10000-20000"
+	MaxPoolCount     int    `yaml:"max_pool_count,omitempty" json:"max_pool_count,omitempty"`       // Cap on idle pooled connections per client
+	HeartbeatTimeout int    `yaml:"heartbeat_timeout,omitempty" json:"heartbeat_timeout,omitempty"` // Seconds of client silence before its session is dropped
+	VhostHTTPPort    int    `yaml:"vhost_http_port,omitempty" json:"vhost_http_port,omitempty"`     // Shared port routing HTTP tunnels by domain
+	VhostHTTPSPort   int    `yaml:"vhost_https_port,omitempty" json:"vhost_https_port,omitempty"`   // Shared port terminating TLS for HTTP tunnels
+	TCPMuxPort       int    `yaml:"tcpmux_port,omitempty" json:"tcpmux_port,omitempty"`             // Shared port routing tcpmux tunnels by HTTP CONNECT
+	TLSCertDir       string `yaml:"tls_cert_dir,omitempty" json:"tls_cert_dir,omitempty"`           // <name>.crt/<name>.key pairs, matched by certificate names
+	TLSCertFile      string `yaml:"tls_cert_file,omitempty" json:"tls_cert_file,omitempty"`         // Default certificate, e.g. a wildcard
+	TLSKeyFile       string `yaml:"tls_key_file,omitempty" json:"tls_key_file,omitempty"`
+	HTTPSRedirect    bool   `yaml:"https_redirect,omitempty" json:"https_redirect,omitempty"` // Redirect vhost HTTP requests to HTTPS when a certificate is available
+	ACMEEnabled      bool   `yaml:"acme_enabled,omitempty" json:"acme_enabled,omitempty"`     // Obtain certificates for custom domains via ACME (HTTP-01)
+	ACMEEmail        string `yaml:"acme_email,omitempty" json:"acme_email,omitempty"`
+	ACMEDirectoryURL string `yaml:"acme_directory_url,omitempty" json:"acme_directory_url,omitempty"` // Defaults to Let's Encrypt
+	ACMECacheDir     string `yaml:"acme_cache_dir,omitempty" json:"acme_cache_dir,omitempty"`         // Where issued certificates are stored (default "acme")
+	ACMECAFile       string `yaml:"acme_ca_file,omitempty" json:"acme_ca_file,omitempty"`             // CA bundle to trust for the directory, e.g. Pebble's
 }
 
 type ClientConfig struct {
-	ServerAddr  string   `yaml:"server_addr" json:"server_addr"`
-	Token       string   `yaml:"token" json:"token"`
-	Tunnels     []Tunnel `yaml:"tunnels" json:"tunnels"`
+	ServerAddr        string    `yaml:"server_addr" json:"server_addr"`
+	Token             string    `yaml:"token" json:"token"`
+	PoolCount         int       `yaml:"pool_count,omitempty" json:"pool_count,omitempty"`                 // Idle data connections kept open on the server
+	HeartbeatInterval int       `yaml:"heartbeat_interval,omitempty" json:"heartbeat_interval,omitempty"` // Seconds between pings
+	HeartbeatTimeout  int       `yaml:"heartbeat_timeout,omitempty" json:"heartbeat_timeout,omitempty"`   // Seconds of server silence before reconnecting
+	InspectLimit      int       `yaml:"inspect_limit,omitempty" json:"inspect_limit,omitempty"`           // Captured requests kept for tunnels with inspect (default 100)
+	InspectBodyLimit  int       `yaml:"inspect_body_limit,omitempty" json:"inspect_body_limit,omitempty"` // Bytes of each body captured (default 64 KiB)
+	Tunnels           []Tunnel  `yaml:"tunnels" json:"tunnels"`
+	Visitors          []Visitor `yaml:"visitors,omitempty" json:"visitors,omitempty"`
 }
 
 type Tunnel struct {
+	Name           string `yaml:"name" json:"name"`
+	Protocol       string `yaml:"protocol" json:"protocol"`                               // tcp, http, etc.
+	LocalAddr      string `yaml:"local_addr" json:"local_addr"`                           // host:port, or unix:///path/to.sock
+	LocalNetwork   string `yaml:"local_network,omitempty" json:"local_network,omitempty"` // tcp (default), unix, unixpacket...
+	RemotePort     int    `yaml:"remote_port" json:"remote_port"`
+	UseCompression bool   `yaml:"use_compression,omitempty" json:"use_compression,omitempty"`
+	Compression    string `yaml:"compression,omitempty" json:"compression,omitempty"` // snappy (default) or zstd
+	UseEncryption  bool   `yaml:"use_encryption,omitempty" json:"use_encryption,omitempty"`
+	SecretKey      string `yaml:"secret_key,omitempty" json:"secret_key,omitempty"`           // Shared with visitors, for protocol "secret"
+	BandwidthLimit int    `yaml:"bandwidth_limit,omitempty" json:"bandwidth_limit,omitempty"` // KiB/s in each direction, shared by the tunnel's connections, 0 for no limit
+
+	// HTTP tunnel options, applied by the server
+	CustomDomains     []string    `yaml:"custom_domains,omitempty" json:"custom_domains,omitempty"` // Routed on the server's vhost_http_port
+	Locations         []string    `yaml:"locations,omitempty" json:"locations,omitempty"`           // URL path prefixes served on custom_domains, default "/"
+	StripLocation     bool        `yaml:"strip_location,omitempty" json:"strip_location,omitempty"` // Remove the matched prefix before forwarding
+	HostHeaderRewrite string      `yaml:"host_header_rewrite,omitempty" json:"host_header_rewrite,omitempty"`
+	RequestHeaders    HeaderRules `yaml:"request_headers,omitempty" json:"request_headers,omitempty"`
+	ResponseHeaders   HeaderRules `yaml:"response_headers,omitempty" json:"response_headers,omitempty"`
+	HTTPUser          string      `yaml:"http_user,omitempty" json:"http_user,omitempty"` // Basic auth enforced by the server
+	HTTPPassword      string      `yaml:"http_password,omitempty" json:"http_password,omitempty"`
+	BearerTokens      []string    `yaml:"bearer_tokens,omitempty" json:"bearer_tokens,omitempty"` // Accepted "Authorization: Bearer" tokens
+
+	// Capture requests and responses for the dashboard inspector, for protocol http
+	Inspect bool `yaml:"inspect,omitempty" json:"inspect,omitempty"`
+
+	// TLS toward the local service, for backends that only speak HTTPS
+	LocalTLS                   bool   `yaml:"local_tls,omitempty" json:"local_tls,omitempty"`
+	LocalTLSServerName         string `yaml:"local_tls_server_name,omitempty" json:"local_tls_server_name,omitempty"` // Defaults to the host of local_addr
+	LocalTLSInsecureSkipVerify bool   `yaml:"local_tls_insecure_skip_verify,omitempty" json:"local_tls_insecure_skip_verify,omitempty"`
+	LocalTLSCAFile             string `yaml:"local_tls_ca_file,omitempty" json:"local_tls_ca_file,omitempty"`     // CA bundle to verify the backend with
+	LocalTLSCertFile           string `yaml:"local_tls_cert_file,omitempty" json:"local_tls_cert_file,omitempty"` // Client certificate for mTLS backends
+	LocalTLSKeyFile            string `yaml:"local_tls_key_file,omitempty" json:"local_tls_key_file,omitempty"`
+
+	// Plugins serve the tunnel themselves instead of forwarding to LocalAddr
+	Plugin         string   `yaml:"plugin,omitempty" json:"plugin,omitempty"` // socks5, http_proxy, static_file
+	PluginUser     string   `yaml:"plugin_user,omitempty" json:"plugin_user,omitempty"`
+	PluginPassword string   `yaml:"plugin_password,omitempty" json:"plugin_password,omitempty"`
+	AllowedCIDRs   []string `yaml:"allowed_cidrs,omitempty" json:"allowed_cidrs,omitempty"` // Destinations proxy plugins may reach, empty allows all
+	LocalPath      string   `yaml:"local_path,omitempty" json:"local_path,omitempty"`       // Directory served by static_file
+	URLPrefix      string   `yaml:"url_prefix,omitempty" json:"url_prefix,omitempty"`       // URL path the static_file plugin serves under
+	DirListing     bool     `yaml:"dir_listing,omitempty" json:"dir_listing,omitempty"`
+}
+
+// HeaderRules sets and removes HTTP headers.
+type HeaderRules struct {
+	Set    map[string]string `yaml:"set,omitempty" json:"set,omitempty"`
+	Remove []string          `yaml:"remove,omitempty" json:"remove,omitempty"`
+}
+
+// Visitor exposes a secret tunnel of another client on a local port.
+type Visitor struct {
 	Name       string `yaml:"name" json:"name"`
-	Protocol   string `yaml:"protocol" json:"protocol"` // tcp, http, etc.
-	LocalAddr  string `yaml:"local_addr" json:"local_addr"`
-	RemotePort int    `yaml:"remote_port" json:"remote_port"`
+	ServerName string `yaml:"server_name" json:"server_name"` // Name of the secret tunnel to visit
+	SecretKey  string `yaml:"secret_key" json:"secret_key"`
+	BindAddr   string `yaml:"bind_addr,omitempty" json:"bind_addr,omitempty"` // Defaults to 127.0.0.1
+	BindPort   int    `yaml:"bind_port" json:"bind_port"`
+}
+
+// LocalTarget returns the network and address to dial for the tunnel's local service.
+// A unix:// or tcp:// scheme on LocalAddr selects the network unless LocalNetwork is set.
+func (t Tunnel) LocalTarget() (string, string) {
+	network, addr := "tcp", t.LocalAddr
+	if scheme, rest, ok := strings.Cut(addr, "://"); ok {
+		network, addr = scheme, rest
+	}
+	if t.LocalNetwork != "" {
+		network = t.LocalNetwork
+	}
+	return network, addr
+}
+
+// CompressionAlgo returns the compression algorithm for the tunnel's data stream, or "" if disabled.
+func (t Tunnel) CompressionAlgo() string {
+	if !t.UseCompression {
+		return ""
+	}
+	if t.Compression == "" {
+		return "snappy"
+	}
+	return t.Compression
+}
+
+// RedactedValue replaces secrets in configs shown to users who may not see them.
+const RedactedValue = "******"
+
+func redact(s string) string {
+	if s == "" {
+		return ""
+	}
+	return RedactedValue
+}
+
+// Redacted returns a copy of c with tokens, passwords and keys masked.
+func (c Config) Redacted() Config {
+	c.Web.Password = redact(c.Web.Password)
+	c.Web.SessionSecret = redact(c.Web.SessionSecret)
+	users := make([]WebUser, len(c.Web.Users))
+	for i, u := range c.Web.Users {
+		u.PasswordHash = redact(u.PasswordHash)
+		users[i] = u
+	}
+	c.Web.Users = users
+	tokens := make([]APIToken, len(c.Web.APITokens))
+	for i, t := range c.Web.APITokens {
+		t.Hash = redact(t.Hash)
+		tokens[i] = t
+	}
+	c.Web.APITokens = tokens
+	c.Server.Token = redact(c.Server.Token)
+	c.Client.Token = redact(c.Client.Token)
+	c.Client.Tunnels = RedactTunnels(c.Client.Tunnels)
+	c.Client.Visitors = RedactVisitors(c.Client.Visitors)
+	return c
+}
+
+// Redacted returns a copy of t with its secret key and credentials masked.
+func (t Tunnel) Redacted() Tunnel {
+	t.SecretKey = redact(t.SecretKey)
+	t.HTTPPassword = redact(t.HTTPPassword)
+	t.PluginPassword = redact(t.PluginPassword)
+	if len(t.BearerTokens) > 0 {
+		tokens := make([]string, len(t.BearerTokens))
+		for i := range tokens {
+			tokens[i] = RedactedValue
+		}
+		t.BearerTokens = tokens
+	}
+	return t
+}
+
+// WithSecretsFrom returns t with secrets that were sent back masked taken from old,
+// so a redacted tunnel can be edited and saved without losing them.
+func (t Tunnel) WithSecretsFrom(old Tunnel) Tunnel {
+	if t.SecretKey == RedactedValue {
+		t.SecretKey = old.SecretKey
+	}
+	if t.HTTPPassword == RedactedValue {
+		t.HTTPPassword = old.HTTPPassword
+	}
+	if t.PluginPassword == RedactedValue {
+		t.PluginPassword = old.PluginPassword
+	}
+	for i := range t.BearerTokens {
+		if t.BearerTokens[i] == RedactedValue && i < len(old.BearerTokens) {
+			t.BearerTokens[i] = old.BearerTokens[i]
+		}
+	}
+	return t
+}
+
+func RedactTunnels(tunnels []Tunnel) []Tunnel {
+	if tunnels == nil {
+		return nil
+	}
+	out := make([]Tunnel, len(tunnels))
+	for i, t := range tunnels {
+		out[i] = t.Redacted()
+	}
+	return out
+}
+
+func RedactVisitors(visitors []Visitor) []Visitor {
+	if visitors == nil {
+		return nil
+	}
+	out := make([]Visitor, len(visitors))
+	for i, v := range visitors {
+		v.SecretKey = redact(v.SecretKey)
+		out[i] = v
+	}
+	return out
 }
 
 func LoadConfig(path string) (*Config, error) {
@@ -53,17 +320,46 @@ func LoadConfig(path string) (*Config, error) {
 	return &cfg, nil
 }
 
-func SaveConfig(path string, cfg *Config) error {
-	data, err := yaml.Marshal(cfg)
-	if err != nil {
-		return err
-	}
-	return os.WriteFile(path, data, 0644)
-}
-
 func (c *Config) Validate() error {
 	if c.Mode != "server" && c.Mode != "client" {
 		return fmt.Errorf("invalid mode: %s", c.Mode)
 	}
+	seen := make(map[string]bool)
+	for _, u := range c.Web.Users {
+		if u.Username == "" {
+			return fmt.Errorf("web user without username")
+		}
+		if seen[u.Username] {
+			return fmt.Errorf("duplicate web user %s", u.Username)
+		}
+		seen[u.Username] = true
+		if u.PasswordHash == "" {
+			return fmt.Errorf("web user %s has no password_hash", u.Username)
+		}
+		switch u.Role {
+		case RoleAdmin, RoleOperator, RoleViewer:
+		default:
+			return fmt.Errorf("web user %s has invalid role %q", u.Username, u.Role)
+		}
+	}
+	if h := c.Web.History; h.Retention1m < 0 || h.Retention1h < 0 || h.Retention1d < 0 {
+		return fmt.Errorf("history retention cannot be negative")
+	}
+	if c.Web.ConfigVersions < -1 {
+		return fmt.Errorf("web.config_versions must be -1 or more")
+	}
+	for _, t := range c.Client.Tunnels {
+		if t.BandwidthLimit < 0 {
+			return fmt.Errorf("tunnel %s bandwidth_limit cannot be negative", t.Name)
+		}
+		if t.HTTPUser != "" && t.HTTPPassword == "" {
+			return fmt.Errorf("tunnel %s http_user requires an http_password", t.Name)
+		}
+		for _, token := range t.BearerTokens {
+			if token == "" {
+				return fmt.Errorf("tunnel %s has an empty bearer token", t.Name)
+			}
+		}
+	}
 	return nil
-}
\ No newline at end of file
+}
@@ -0,0 +1,166 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// How many earlier versions of the config file are kept, unless web.config_versions says otherwise
+const defaultConfigVersions = 20
+
+// ErrVersionNotFound is returned for versions that were never saved or have been pruned.
+var ErrVersionNotFound = errors.New("config version not found")
+
+// Version is an earlier content of the config file, kept when it was overwritten.
+type Version struct {
+	Number int       `json:"version"`
+	Time   time.Time `json:"time"` // When it was replaced
+	Size   int64     `json:"size"`
+}
+
+// versionsDir returns the directory holding the earlier versions of the config file at path.
+func versionsDir(path string) string {
+	return path + ".versions"
+}
+
+func versionPath(path string, n int) string {
+	return filepath.Join(versionsDir(path), strconv.Itoa(n)+".yaml")
+}
+
+// ListVersions returns the kept versions of the config file at path, newest first.
+func ListVersions(path string) ([]Version, error) {
+	entries, err := os.ReadDir(versionsDir(path))
+	if os.IsNotExist(err) {
+		return []Version{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	versions := []Version{}
+	for _, e := range entries {
+		n, err := strconv.Atoi(strings.TrimSuffix(e.Name(), ".yaml"))
+		if err != nil || !strings.HasSuffix(e.Name(), ".yaml") {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		versions = append(versions, Version{Number: n, Time: info.ModTime(), Size: info.Size()})
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i].Number > versions[j].Number })
+	return versions, nil
+}
+
+// LoadVersion reads version n of the config file at path.
+func LoadVersion(path string, n int) (*Config, error) {
+	cfg, err := LoadConfig(versionPath(path, n))
+	if os.IsNotExist(err) {
+		return nil, ErrVersionNotFound
+	}
+	return cfg, err
+}
+
+// keepVersion copies the config file at path to a new version, unless the
+// latest version already has the same content, then prunes the oldest versions
+// beyond keep.
+func keepVersion(path string, keep int) error {
+	current, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	versions, err := ListVersions(path)
+	if err != nil {
+		return err
+	}
+
+	next := 1
+	if len(versions) > 0 {
+		next = versions[0].Number + 1
+		latest, err := os.ReadFile(versionPath(path, versions[0].Number))
+		if err == nil && bytes.Equal(latest, current) {
+			next = 0
+		}
+	}
+	if next > 0 {
+		if err := os.MkdirAll(versionsDir(path), 0700); err != nil {
+			return err
+		}
+		if err := writeAtomic(versionPath(path, next), current, 0600); err != nil {
+			return err
+		}
+		versions = append([]Version{{Number: next}}, versions...)
+	}
+
+	for _, v := range versions[min(keep, len(versions)):] {
+		os.Remove(versionPath(path, v.Number))
+	}
+	return nil
+}
+
+// writeAtomic replaces the file at path with data, so readers and crashes see
+// either the old or the new content, never a partial one.
+func writeAtomic(path string, data []byte, perm os.FileMode) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp) // Fails harmlessly once renamed
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp, perm); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("replace %s: %v", path, err)
+	}
+	return nil
+}
+
+// SaveConfig writes cfg to the config file at path atomically. The content it
+// replaces is kept as a numbered version first.
+func SaveConfig(path string, cfg *Config) error {
+	data, err := yaml.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+
+	keep := cfg.Web.ConfigVersions
+	if keep == 0 {
+		keep = defaultConfigVersions
+	}
+	if keep > 0 {
+		if err := keepVersion(path, keep); err != nil {
+			return fmt.Errorf("keep previous config version: %v", err)
+		}
+	}
+
+	perm := os.FileMode(0644)
+	if info, err := os.Stat(path); err == nil {
+		perm = info.Mode().Perm()
+	}
+	return writeAtomic(path, data, perm)
+}
@@ -0,0 +1,120 @@
+// Package conntrack keeps track of the connections proxied through tunnels, so
+// they can be listed with their traffic and closed from the dashboard.
+package conntrack
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"openproxy/internal/api"
+	"openproxy/internal/events"
+	"openproxy/internal/transport"
+)
+
+// ErrNotFound is returned by Kill for connections that are not tracked (anymore).
+var ErrNotFound = errors.New("connection not found")
+
+// Conn is a tracked connection.
+type Conn struct {
+	info     api.Connection
+	closer   net.Conn // Closed to kill the connection
+	bytesIn  int64
+	bytesOut int64
+
+	// Counters at the previous sample, for the rates
+	lastIn  int64
+	lastOut int64
+}
+
+// Count returns conn counting its traffic toward c.
+func (c *Conn) Count(conn net.Conn) net.Conn {
+	return transport.CountBytes(conn, &c.bytesIn, &c.bytesOut)
+}
+
+type Registry struct {
+	conns map[string]*Conn
+	mu    sync.Mutex
+}
+
+func NewRegistry() *Registry {
+	return &Registry{conns: make(map[string]*Conn)}
+}
+
+// Add tracks a new connection. Closing conn must end it.
+func (r *Registry) Add(info api.Connection, conn net.Conn) *Conn {
+	c := &Conn{info: info, closer: conn}
+	r.mu.Lock()
+	r.conns[info.ID] = c
+	r.mu.Unlock()
+	return c
+}
+
+// SetState changes the state of a tracked connection.
+func (r *Registry) SetState(id, state string) {
+	r.mu.Lock()
+	if c, ok := r.conns[id]; ok {
+		c.info.State = state
+	}
+	r.mu.Unlock()
+}
+
+// Remove stops tracking a connection that has ended.
+func (r *Registry) Remove(id string) {
+	r.mu.Lock()
+	delete(r.conns, id)
+	r.mu.Unlock()
+}
+
+// Kill closes a tracked connection. It is removed once its bridge has wound down.
+func (r *Registry) Kill(id string) (api.Connection, error) {
+	r.mu.Lock()
+	c, ok := r.conns[id]
+	r.mu.Unlock()
+	if !ok {
+		return api.Connection{}, ErrNotFound
+	}
+	c.closer.Close()
+	return c.info, nil
+}
+
+// List returns the tracked connections with their traffic.
+func (r *Registry) List() []api.Connection {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	conns := make([]api.Connection, 0, len(r.conns))
+	for _, c := range r.conns {
+		info := c.info
+		info.BytesIn = atomic.LoadInt64(&c.bytesIn)
+		info.BytesOut = atomic.LoadInt64(&c.bytesOut)
+		conns = append(conns, info)
+	}
+	return conns
+}
+
+// SampleRates updates the throughput of every connection each
+// events.TrafficSampleInterval. It never returns.
+func (r *Registry) SampleRates() {
+	ticker := time.NewTicker(events.TrafficSampleInterval)
+	defer ticker.Stop()
+
+	lastTime := time.Now()
+	for now := range ticker.C {
+		elapsed := now.Sub(lastTime).Seconds()
+		lastTime = now
+		if elapsed <= 0 {
+			continue
+		}
+
+		r.mu.Lock()
+		for _, c := range r.conns {
+			in, out := atomic.LoadInt64(&c.bytesIn), atomic.LoadInt64(&c.bytesOut)
+			c.info.RateIn = float64(in-c.lastIn) / elapsed
+			c.info.RateOut = float64(out-c.lastOut) / elapsed
+			c.lastIn, c.lastOut = in, out
+		}
+		r.mu.Unlock()
+	}
+}
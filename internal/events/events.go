@@ -0,0 +1,124 @@
+package events
+
+import (
+	"sync"
+	"time"
+)
+
+// Type names a kind of status change pushed to the Web UI.
+type Type string
+
+const (
+	ClientConnect    Type = "client_connect"
+	ClientDisconnect Type = "client_disconnect"
+	TunnelRegister   Type = "tunnel_register"
+	TunnelUnregister Type = "tunnel_unregister"
+	ConnOpen         Type = "conn_open"
+	ConnClose        Type = "conn_close"
+	Traffic          Type = "traffic"
+	Error            Type = "error"
+
+	// Status carries the full status and is only sent first to new Web UI connections
+	Status Type = "status"
+)
+
+// How many events a subscriber may lag behind before new ones are dropped for it
+const subscriberBuffer = 256
+
+// TrafficSampleInterval is how often the server and client publish traffic samples.
+const TrafficSampleInterval = 2 * time.Second
+
+type Event struct {
+	Type Type        `json:"type"`
+	Time time.Time   `json:"time"`
+	Data interface{} `json:"data,omitempty"`
+}
+
+// Bus fans out events to every subscriber. Publishing never blocks, a subscriber
+// that falls behind misses events rather than stalling the proxy.
+type Bus struct {
+	mu   sync.Mutex
+	subs map[chan Event]struct{}
+}
+
+func NewBus() *Bus {
+	return &Bus{subs: make(map[chan Event]struct{})}
+}
+
+// Subscribe returns a channel receiving every event published from now on.
+func (b *Bus) Subscribe() chan Event {
+	ch := make(chan Event, subscriberBuffer)
+	b.mu.Lock()
+	b.subs[ch] = struct{}{}
+	b.mu.Unlock()
+	return ch
+}
+
+// Unsubscribe stops delivery to ch and closes it.
+func (b *Bus) Unsubscribe(ch chan Event) {
+	b.mu.Lock()
+	if _, ok := b.subs[ch]; ok {
+		delete(b.subs, ch)
+		close(ch)
+	}
+	b.mu.Unlock()
+}
+
+// HasSubscribers reports whether anyone is listening, so callers can skip building costly events.
+func (b *Bus) HasSubscribers() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.subs) > 0
+}
+
+func (b *Bus) Publish(typ Type, data interface{}) {
+	ev := Event{Type: typ, Time: time.Now(), Data: data}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subs {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// TunnelTraffic is a tunnel's cumulative byte counters at the time of a sample.
+type TunnelTraffic struct {
+	Name        string  `json:"name"`
+	BytesIn     int64   `json:"bytes_in"`
+	BytesOut    int64   `json:"bytes_out"`
+	RateIn      float64 `json:"rate_in"` // Bytes per second since the previous sample
+	RateOut     float64 `json:"rate_out"`
+	ActiveConns int64   `json:"active_conns"`
+}
+
+// SampleTraffic publishes a Traffic event with the counters returned by snapshot
+// every TrafficSampleInterval. It never returns.
+func (b *Bus) SampleTraffic(snapshot func() []TunnelTraffic) {
+	ticker := time.NewTicker(TrafficSampleInterval)
+	defer ticker.Stop()
+
+	last := make(map[string]TunnelTraffic)
+	lastTime := time.Now()
+	for now := range ticker.C {
+		elapsed := now.Sub(lastTime).Seconds()
+		lastTime = now
+
+		samples := snapshot()
+		next := make(map[string]TunnelTraffic, len(samples))
+		for i := range samples {
+			cur := &samples[i]
+			if prev, ok := last[cur.Name]; ok && elapsed > 0 {
+				cur.RateIn = float64(cur.BytesIn-prev.BytesIn) / elapsed
+				cur.RateOut = float64(cur.BytesOut-prev.BytesOut) / elapsed
+			}
+			next[cur.Name] = *cur
+		}
+		last = next
+
+		if b.HasSubscribers() {
+			b.Publish(Traffic, samples)
+		}
+	}
+}
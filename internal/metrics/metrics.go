@@ -0,0 +1,346 @@
+// Package metrics keeps a history of per-tunnel traffic for the dashboard charts.
+// Traffic samples are rolled up into 1 minute, 1 hour and 1 day buckets, each
+// resolution stored as an append-only JSON lines file that is compacted as old
+// buckets expire.
+package metrics
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"openproxy/internal/config"
+	"openproxy/internal/events"
+)
+
+const (
+	defaultDir          = "metrics"
+	defaultRetention1m  = 2   // Days
+	defaultRetention1h  = 90  // Days
+	defaultRetention1d  = 730 // Days
+	maxPointsPerQuery   = 1500
+	compactionThreshold = 1000 // Expired lines a file may keep before it is rewritten
+)
+
+// Point is the traffic of one tunnel during one bucket.
+type Point struct {
+	Time     int64  `json:"t"` // Unix seconds at the start of the bucket
+	Tunnel   string `json:"tunnel,omitempty"`
+	BytesIn  int64  `json:"in"`
+	BytesOut int64  `json:"out"`
+	Conns    int64  `json:"conns"` // Peak of active connections
+}
+
+// Series is the history of one tunnel.
+type Series struct {
+	Tunnel string  `json:"tunnel"`
+	Points []Point `json:"points"`
+}
+
+// History is the answer to a query, with points step seconds apart. Buckets
+// without traffic are left out.
+type History struct {
+	Step   string    `json:"step"`
+	From   time.Time `json:"from"`
+	To     time.Time `json:"to"`
+	Series []Series  `json:"series"`
+}
+
+// tier stores the buckets of one resolution. Closed buckets of a tier are
+// added up into the next, coarser one.
+type tier struct {
+	name      string
+	step      time.Duration
+	retention time.Duration
+	path      string
+	file      *os.File
+	points    []Point           // Closed buckets, oldest first
+	open      map[string]*Point // Bucket being filled, by tunnel
+	expired   int               // Lines in the file older than the retention
+	next      *tier
+}
+
+type Store struct {
+	tiers []*tier
+	last  map[string]events.TunnelTraffic // Previous counters, by tunnel
+	mu    sync.Mutex
+}
+
+// Open loads the stored history from the directory in cfg.
+func Open(cfg config.HistoryConfig) (*Store, error) {
+	dir := cfg.Dir
+	if dir == "" {
+		dir = defaultDir
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	days := func(n, def int) time.Duration {
+		if n <= 0 {
+			n = def
+		}
+		return time.Duration(n) * 24 * time.Hour
+	}
+	s := &Store{
+		tiers: []*tier{
+			{name: "1m", step: time.Minute, retention: days(cfg.Retention1m, defaultRetention1m)},
+			{name: "1h", step: time.Hour, retention: days(cfg.Retention1h, defaultRetention1h)},
+			{name: "1d", step: 24 * time.Hour, retention: days(cfg.Retention1d, defaultRetention1d)},
+		},
+		last: make(map[string]events.TunnelTraffic),
+	}
+	for i, t := range s.tiers {
+		t.path = filepath.Join(dir, "traffic-"+t.name+".jsonl")
+		t.open = make(map[string]*Point)
+		if i+1 < len(s.tiers) {
+			t.next = s.tiers[i+1]
+		}
+		if err := t.load(); err != nil {
+			return nil, fmt.Errorf("load %s: %v", t.path, err)
+		}
+	}
+
+	// Buckets of the finer resolutions that were not added up before the last
+	// stop fill the open buckets again
+	for i, t := range s.tiers[1:] {
+		var last int64 = -1
+		if n := len(t.points); n > 0 {
+			last = t.points[n-1].Time
+		}
+		for _, p := range s.tiers[i].points {
+			if last < 0 || p.Time >= last+int64(t.step/time.Second) {
+				t.add(p, false)
+			}
+		}
+	}
+	now := time.Now()
+	for _, t := range s.tiers {
+		t.closeBuckets(now)
+	}
+	return s, nil
+}
+
+// load reads the buckets of t still within its retention and opens its file for appending.
+func (t *tier) load() error {
+	f, err := os.Open(t.path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if f != nil {
+		cutoff := time.Now().Add(-t.retention).Unix()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var p Point
+			if err := json.Unmarshal(scanner.Bytes(), &p); err != nil {
+				// A torn last line after a crash, the rest of the file is fine
+				continue
+			}
+			if p.Time < cutoff {
+				t.expired++
+				continue
+			}
+			t.points = append(t.points, p)
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+		sort.SliceStable(t.points, func(i, j int) bool { return t.points[i].Time < t.points[j].Time })
+	}
+	if t.expired > 0 {
+		return t.compact()
+	}
+	t.file, err = os.OpenFile(t.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	return err
+}
+
+// compact rewrites the file of t without its expired buckets.
+func (t *tier) compact() error {
+	tmp := t.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, p := range t.points {
+		enc.Encode(p)
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if t.file != nil {
+		t.file.Close()
+	}
+	if err := os.Rename(tmp, t.path); err != nil {
+		return err
+	}
+	t.expired = 0
+	t.file, err = os.OpenFile(t.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	return err
+}
+
+// add counts p into the open bucket of its tunnel. An older bucket still open
+// for the tunnel is closed first, and with rollup added to the next tier.
+func (t *tier) add(p Point, rollup bool) {
+	bucket := time.Unix(p.Time, 0).Truncate(t.step).Unix()
+	o, ok := t.open[p.Tunnel]
+	if ok && o.Time != bucket {
+		delete(t.open, p.Tunnel)
+		t.store(*o, rollup)
+		ok = false
+	}
+	if !ok {
+		o = &Point{Time: bucket, Tunnel: p.Tunnel}
+		t.open[p.Tunnel] = o
+	}
+	o.BytesIn += p.BytesIn
+	o.BytesOut += p.BytesOut
+	if p.Conns > o.Conns {
+		o.Conns = p.Conns
+	}
+}
+
+// store writes the closed bucket p. Buckets without any traffic are left out.
+func (t *tier) store(p Point, rollup bool) {
+	if p.BytesIn == 0 && p.BytesOut == 0 && p.Conns == 0 {
+		return
+	}
+	if err := json.NewEncoder(t.file).Encode(p); err != nil {
+		log.Printf("Failed to store traffic history: %v", err)
+	}
+	t.points = append(t.points, p)
+	if rollup && t.next != nil {
+		t.next.add(p, true)
+	}
+}
+
+// closeBuckets stores the buckets of t that ended before now and drops the
+// ones past the retention.
+func (t *tier) closeBuckets(now time.Time) {
+	start := now.Truncate(t.step).Unix()
+	var closed []Point
+	for name, p := range t.open {
+		if p.Time < start {
+			delete(t.open, name)
+			closed = append(closed, *p)
+		}
+	}
+	sort.Slice(closed, func(i, j int) bool { return closed[i].Tunnel < closed[j].Tunnel })
+	for _, p := range closed {
+		t.store(p, true)
+	}
+
+	cutoff := now.Add(-t.retention).Unix()
+	n := sort.Search(len(t.points), func(i int) bool { return t.points[i].Time >= cutoff })
+	if n > 0 {
+		t.points = append([]Point(nil), t.points[n:]...)
+		t.expired += n
+	}
+	if t.expired > compactionThreshold {
+		if err := t.compact(); err != nil {
+			log.Printf("Failed to compact %s: %v", t.path, err)
+		}
+	}
+}
+
+// add counts the traffic since the previous sample into the open minute buckets.
+func (s *Store) add(samples []events.TunnelTraffic, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, t := range s.tiers {
+		t.closeBuckets(now)
+	}
+
+	seen := make(map[string]bool, len(samples))
+	for _, cur := range samples {
+		seen[cur.Name] = true
+		in, out := cur.BytesIn, cur.BytesOut
+		if prev, ok := s.last[cur.Name]; ok && prev.BytesIn <= in && prev.BytesOut <= out {
+			in -= prev.BytesIn
+			out -= prev.BytesOut
+		}
+		// Otherwise the counters started over with a new tunnel, count them from zero
+		s.last[cur.Name] = cur
+		s.tiers[0].add(Point{Time: now.Unix(), Tunnel: cur.Name, BytesIn: in, BytesOut: out, Conns: cur.ActiveConns}, true)
+	}
+	for name := range s.last {
+		if !seen[name] {
+			delete(s.last, name)
+		}
+	}
+}
+
+// Record stores the traffic published on bus. It never returns.
+func (s *Store) Record(bus *events.Bus) {
+	ch := bus.Subscribe()
+	defer bus.Unsubscribe(ch)
+	for ev := range ch {
+		if samples, ok := ev.Data.([]events.TunnelTraffic); ok && ev.Type == events.Traffic {
+			s.add(samples, ev.Time)
+		}
+	}
+}
+
+// Query returns the history between from and to. An empty step picks the finest
+// resolution that covers the range in a reasonable number of points, an empty
+// tunnel returns every tunnel.
+func (s *Store) Query(from, to time.Time, step, tunnel string) (History, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var t *tier
+	for _, candidate := range s.tiers {
+		if step == candidate.name {
+			t = candidate
+			break
+		}
+		if step == "" && time.Since(from) <= candidate.retention && to.Sub(from) <= candidate.step*maxPointsPerQuery {
+			t = candidate
+			break
+		}
+	}
+	if t == nil {
+		if step != "" {
+			return History{}, fmt.Errorf("unknown step %q, use 1m, 1h or 1d", step)
+		}
+		t = s.tiers[len(s.tiers)-1]
+	}
+
+	byTunnel := make(map[string][]Point)
+	add := func(p Point) {
+		if p.Time < from.Truncate(t.step).Unix() || p.Time > to.Unix() || (tunnel != "" && p.Tunnel != tunnel) {
+			return
+		}
+		name := p.Tunnel
+		p.Tunnel = ""
+		byTunnel[name] = append(byTunnel[name], p)
+	}
+	for _, p := range t.points {
+		add(p)
+	}
+	for _, p := range t.open {
+		if p.BytesIn != 0 || p.BytesOut != 0 || p.Conns != 0 {
+			add(*p)
+		}
+	}
+
+	h := History{Step: t.name, From: from, To: to, Series: []Series{}}
+	for name, points := range byTunnel {
+		h.Series = append(h.Series, Series{Tunnel: name, Points: points})
+	}
+	sort.Slice(h.Series, func(i, j int) bool { return h.Series[i].Tunnel < h.Series[j].Tunnel })
+	return h, nil
+}
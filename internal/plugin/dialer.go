@@ -0,0 +1,81 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ErrNotAllowed is returned for destinations outside the allowed CIDRs.
+var ErrNotAllowed = errors.New("destination not allowed")
+
+// Dialer connects to proxy destinations, restricted to a set of CIDRs.
+type Dialer struct {
+	allowed []*net.IPNet
+}
+
+// NewDialer parses the allowed destination CIDRs. An empty list allows every destination.
+// Plain IPs are accepted as single-host networks.
+func NewDialer(cidrs []string) (*Dialer, error) {
+	d := &Dialer{}
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid allowed CIDR: %s", cidr)
+			}
+			if ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowed CIDR: %s", cidr)
+		}
+		d.allowed = append(d.allowed, ipNet)
+	}
+	return d, nil
+}
+
+func (d *Dialer) isAllowed(ip net.IP) bool {
+	if len(d.allowed) == 0 {
+		return true
+	}
+	for _, ipNet := range d.allowed {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// DialContext resolves addr and connects to the first allowed address.
+// Checking resolved IPs rather than host names keeps DNS from bypassing the allowlist.
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	lastErr := ErrNotAllowed
+	for _, ip := range ips {
+		if !d.isAllowed(ip.IP) {
+			continue
+		}
+		var nd net.Dialer
+		conn, err := nd.DialContext(ctx, network, net.JoinHostPort(ip.IP.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
@@ -0,0 +1,121 @@
+package plugin
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+
+	"openproxy/internal/transport"
+)
+
+// httpProxyPlugin implements a forward HTTP proxy, including CONNECT for HTTPS.
+type httpProxyPlugin struct {
+	user     string
+	password string
+	dialer   *Dialer
+	tr       *http.Transport
+	proxy    *httputil.ReverseProxy
+}
+
+func newHTTPProxyPlugin(user, password string, dialer *Dialer) *httpProxyPlugin {
+	p := &httpProxyPlugin{user: user, password: password, dialer: dialer, tr: &http.Transport{DialContext: dialer.DialContext}}
+	p.proxy = &httputil.ReverseProxy{
+		// Requests already carry the absolute target URL, forward them unchanged.
+		// Unlike Director, Rewrite does not add X-Forwarded-For, which a forward proxy should not leak.
+		Rewrite:   func(*httputil.ProxyRequest) {},
+		Transport: p.tr,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			status := http.StatusBadGateway
+			if errors.Is(err, ErrNotAllowed) {
+				status = http.StatusForbidden
+			}
+			http.Error(w, err.Error(), status)
+		},
+	}
+	return p
+}
+
+func (p *httpProxyPlugin) Handle(conn net.Conn) {
+	defer conn.Close()
+	// The plugin is made per connection, its upstream connections go with it
+	defer p.tr.CloseIdleConnections()
+	transport.ServeHTTP(conn, p)
+}
+
+func (p *httpProxyPlugin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !p.authorized(r) {
+		w.Header().Set("Proxy-Authenticate", `Basic realm="openproxy"`)
+		http.Error(w, "Proxy Authentication Required", http.StatusProxyAuthRequired)
+		return
+	}
+
+	if r.Method == http.MethodConnect {
+		p.handleConnect(w, r)
+		return
+	}
+
+	if !r.URL.IsAbs() {
+		http.Error(w, "This is a proxy, requests must use an absolute URL", http.StatusBadRequest)
+		return
+	}
+	p.proxy.ServeHTTP(w, r)
+}
+
+func (p *httpProxyPlugin) handleConnect(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), dialTimeout)
+	dst, err := p.dialer.DialContext(ctx, "tcp", r.Host)
+	cancel()
+	if err != nil {
+		status := http.StatusBadGateway
+		if errors.Is(err, ErrNotAllowed) {
+			status = http.StatusForbidden
+		}
+		log.Printf("HTTP proxy CONNECT to %s failed: %v", r.Host, err)
+		http.Error(w, err.Error(), status)
+		return
+	}
+	defer dst.Close()
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+	conn, bufrw, err := hijacker.Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+		return
+	}
+
+	go io.Copy(dst, bufrw)
+	io.Copy(conn, dst)
+}
+
+func (p *httpProxyPlugin) authorized(r *http.Request) bool {
+	if p.user == "" {
+		return true
+	}
+	auth := r.Header.Get("Proxy-Authorization")
+	const prefix = "Basic "
+	if !strings.HasPrefix(auth, prefix) {
+		return false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(auth[len(prefix):])
+	if err != nil {
+		return false
+	}
+	user, pass, ok := strings.Cut(string(decoded), ":")
+	return ok && subtle.ConstantTimeCompare([]byte(user), []byte(p.user)) == 1 &&
+		subtle.ConstantTimeCompare([]byte(pass), []byte(p.password)) == 1
+}
@@ -0,0 +1,39 @@
+package plugin
+
+import (
+	"fmt"
+	"net"
+
+	"openproxy/internal/config"
+)
+
+const (
+	TypeSocks5     = "socks5"
+	TypeHTTPProxy  = "http_proxy"
+	TypeStaticFile = "static_file"
+)
+
+// Plugin serves a tunnel data connection itself instead of forwarding it to a local address.
+// Handle owns conn and closes it when done.
+type Plugin interface {
+	Handle(conn net.Conn)
+}
+
+// New creates the plugin configured on the tunnel.
+func New(t config.Tunnel) (Plugin, error) {
+	switch t.Plugin {
+	case TypeSocks5, TypeHTTPProxy:
+		dialer, err := NewDialer(t.AllowedCIDRs)
+		if err != nil {
+			return nil, err
+		}
+		if t.Plugin == TypeSocks5 {
+			return &socks5Plugin{user: t.PluginUser, password: t.PluginPassword, dialer: dialer}, nil
+		}
+		return newHTTPProxyPlugin(t.PluginUser, t.PluginPassword, dialer), nil
+	case TypeStaticFile:
+		return newStaticFilePlugin(t.LocalPath, t.URLPrefix, t.PluginUser, t.PluginPassword, t.DirListing)
+	default:
+		return nil, fmt.Errorf("unknown plugin: %s", t.Plugin)
+	}
+}
@@ -0,0 +1,191 @@
+package plugin
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	socks5Version      = 0x05
+	socks5AuthNone     = 0x00
+	socks5AuthPassword = 0x02
+	socks5NoAcceptable = 0xff
+	socks5CmdConnect   = 0x01
+
+	socks5AtypIPv4   = 0x01
+	socks5AtypDomain = 0x03
+	socks5AtypIPv6   = 0x04
+
+	socks5RepSuccess         = 0x00
+	socks5RepNotAllowed      = 0x02
+	socks5RepHostUnreach     = 0x04
+	socks5RepCmdUnsupported  = 0x07
+	socks5RepAtypUnsupported = 0x08
+)
+
+const dialTimeout = 10 * time.Second
+
+// socks5Plugin implements a SOCKS5 server (RFC 1928) supporting CONNECT,
+// with optional username/password authentication (RFC 1929).
+type socks5Plugin struct {
+	user     string
+	password string
+	dialer   *Dialer
+}
+
+func (p *socks5Plugin) Handle(conn net.Conn) {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+
+	if err := p.negotiateAuth(br, conn); err != nil {
+		log.Printf("SOCKS5 handshake from tunnel failed: %v", err)
+		return
+	}
+
+	target, err := p.readRequest(br, conn)
+	if err != nil {
+		log.Printf("SOCKS5 request failed: %v", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	dst, err := p.dialer.DialContext(ctx, "tcp", target)
+	cancel()
+	if err != nil {
+		rep := byte(socks5RepHostUnreach)
+		if errors.Is(err, ErrNotAllowed) {
+			rep = socks5RepNotAllowed
+		}
+		writeSocks5Reply(conn, rep)
+		log.Printf("SOCKS5 connect to %s failed: %v", target, err)
+		return
+	}
+	defer dst.Close()
+
+	if err := writeSocks5Reply(conn, socks5RepSuccess); err != nil {
+		return
+	}
+
+	go io.Copy(dst, br)
+	io.Copy(conn, dst)
+}
+
+func (p *socks5Plugin) negotiateAuth(br *bufio.Reader, conn net.Conn) error {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return err
+	}
+	if header[0] != socks5Version {
+		return errors.New("unsupported SOCKS version " + strconv.Itoa(int(header[0])))
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(br, methods); err != nil {
+		return err
+	}
+
+	want := byte(socks5AuthNone)
+	if p.user != "" {
+		want = socks5AuthPassword
+	}
+	offered := false
+	for _, m := range methods {
+		if m == want {
+			offered = true
+			break
+		}
+	}
+	if !offered {
+		conn.Write([]byte{socks5Version, socks5NoAcceptable})
+		return errors.New("no acceptable authentication method")
+	}
+	if _, err := conn.Write([]byte{socks5Version, want}); err != nil {
+		return err
+	}
+	if want == socks5AuthNone {
+		return nil
+	}
+
+	// Username/password sub-negotiation: VER ULEN UNAME PLEN PASSWD
+	ver := make([]byte, 2)
+	if _, err := io.ReadFull(br, ver); err != nil {
+		return err
+	}
+	user := make([]byte, ver[1])
+	if _, err := io.ReadFull(br, user); err != nil {
+		return err
+	}
+	plen, err := br.ReadByte()
+	if err != nil {
+		return err
+	}
+	pass := make([]byte, plen)
+	if _, err := io.ReadFull(br, pass); err != nil {
+		return err
+	}
+
+	if subtle.ConstantTimeCompare(user, []byte(p.user)) != 1 || subtle.ConstantTimeCompare(pass, []byte(p.password)) != 1 {
+		conn.Write([]byte{0x01, 0x01})
+		return errors.New("invalid credentials")
+	}
+	_, err = conn.Write([]byte{0x01, 0x00})
+	return err
+}
+
+// readRequest reads VER CMD RSV ATYP DST.ADDR DST.PORT and returns the target address.
+func (p *socks5Plugin) readRequest(br *bufio.Reader, conn net.Conn) (string, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return "", err
+	}
+	if header[1] != socks5CmdConnect {
+		writeSocks5Reply(conn, socks5RepCmdUnsupported)
+		return "", errors.New("unsupported command " + strconv.Itoa(int(header[1])))
+	}
+
+	var host string
+	switch header[3] {
+	case socks5AtypIPv4, socks5AtypIPv6:
+		size := net.IPv4len
+		if header[3] == socks5AtypIPv6 {
+			size = net.IPv6len
+		}
+		ip := make([]byte, size)
+		if _, err := io.ReadFull(br, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case socks5AtypDomain:
+		n, err := br.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		domain := make([]byte, n)
+		if _, err := io.ReadFull(br, domain); err != nil {
+			return "", err
+		}
+		host = string(domain)
+	default:
+		writeSocks5Reply(conn, socks5RepAtypUnsupported)
+		return "", errors.New("unsupported address type")
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(br, port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+func writeSocks5Reply(conn net.Conn, rep byte) error {
+	// The bound address is not meaningful through a tunnel, report 0.0.0.0:0
+	_, err := conn.Write([]byte{socks5Version, rep, 0x00, socks5AtypIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
@@ -0,0 +1,85 @@
+package plugin
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"openproxy/internal/transport"
+)
+
+// staticFilePlugin serves files from a local directory over the tunnel.
+type staticFilePlugin struct {
+	handler http.Handler
+}
+
+func newStaticFilePlugin(localPath, urlPrefix, user, password string, dirListing bool) (*staticFilePlugin, error) {
+	if localPath == "" {
+		return nil, fmt.Errorf("static_file plugin requires local_path")
+	}
+
+	var fsys http.FileSystem = http.Dir(localPath)
+	if !dirListing {
+		fsys = noListingFS{fsys}
+	}
+	handler := http.FileServer(fsys)
+
+	if prefix := strings.TrimRight(urlPrefix, "/"); prefix != "" {
+		if !strings.HasPrefix(prefix, "/") {
+			prefix = "/" + prefix
+		}
+		handler = http.StripPrefix(prefix, handler)
+	}
+
+	if user != "" {
+		handler = basicAuth(handler, user, password)
+	}
+	return &staticFilePlugin{handler: handler}, nil
+}
+
+func (p *staticFilePlugin) Handle(conn net.Conn) {
+	defer conn.Close()
+	transport.ServeHTTP(conn, p.handler)
+}
+
+// noListingFS hides directories without an index.html, so http.FileServer cannot list them.
+type noListingFS struct {
+	fs http.FileSystem
+}
+
+func (n noListingFS) Open(name string) (http.File, error) {
+	f, err := n.fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if stat.IsDir() {
+		index, err := n.fs.Open(path.Join(name, "index.html"))
+		if err != nil {
+			f.Close()
+			return nil, os.ErrNotExist
+		}
+		index.Close()
+	}
+	return f, nil
+}
+
+func basicAuth(next http.Handler, user, password string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, p, ok := r.BasicAuth()
+		if !ok || subtle.ConstantTimeCompare([]byte(u), []byte(user)) != 1 || subtle.ConstantTimeCompare([]byte(p), []byte(password)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="Restricted"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
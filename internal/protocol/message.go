@@ -1,21 +1,30 @@
 package protocol
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"io"
+	"strconv"
 )
 
 type MessageType string
 
 const (
-	TypeAuth      MessageType = "auth"
-	TypeAuthResp  MessageType = "auth_resp"
-	TypeRegTunnel MessageType = "reg_tunnel"
-	TypeRegResp   MessageType = "reg_resp"
-	TypeNewConn   MessageType = "new_conn"
-	TypeProxyData MessageType = "proxy_data"
-	TypePing      MessageType = "ping"
-	TypePong      MessageType = "pong"
+	TypeAuth        MessageType = "auth"
+	TypeAuthResp    MessageType = "auth_resp"
+	TypeRegTunnel   MessageType = "reg_tunnel"
+	TypeRegResp     MessageType = "reg_resp"
+	TypeUnregTunnel MessageType = "unreg_tunnel" // Answered with TypeRegResp
+	TypeNewConn     MessageType = "new_conn"
+	TypeProxyData   MessageType = "proxy_data"
+	TypePoolConn    MessageType = "pool_conn"
+	TypeStartWork   MessageType = "start_work"
+	TypeVisitor     MessageType = "visitor"
+	TypeVisitorResp MessageType = "visitor_resp"
+	TypePing        MessageType = "ping"
+	TypePong        MessageType = "pong"
 )
 
 type Message struct {
@@ -23,28 +32,75 @@ type Message struct {
 	Payload json.RawMessage `json:"payload,omitempty"`
 }
 
+const (
+	ConnTypeControl = "control"
+	ConnTypeData    = "data"
+)
+
 type AuthRequest struct {
-	Token string `json:"token"`
+	Token             string `json:"token"`
+	ConnType          string `json:"conn_type,omitempty"`          // control (default) or data
+	HeartbeatInterval int    `json:"heartbeat_interval,omitempty"` // Seconds between client pings
 }
 
 type AuthResponse struct {
-	Success bool   `json:"success"`
-	Error   string `json:"error,omitempty"`
+	Success      bool   `json:"success"`
+	Error        string `json:"error,omitempty"`
+	SessionID    string `json:"session_id,omitempty"`     // Only set for control connections
+	MaxPoolCount int    `json:"max_pool_count,omitempty"` // Upper bound for idle pooled data connections
+
+	// Negotiated heartbeat settings in seconds, both sides ping at the same interval
+	HeartbeatInterval int `json:"heartbeat_interval,omitempty"`
+	HeartbeatTimeout  int `json:"heartbeat_timeout,omitempty"`
+}
+
+// Ping carries the sender's clock so the Pong echoing it back yields a round-trip time.
+type Ping struct {
+	Timestamp int64 `json:"timestamp"` // Unix nanoseconds
 }
 
 type RegTunnelRequest struct {
-	Name       string `json:"name"`
-	Protocol   string `json:"protocol"`
-	RemotePort int    `json:"remote_port"`
+	ID            uint64 `json:"id,omitempty"` // Echoed in the response, so concurrent requests are told apart
+	Name          string `json:"name"`
+	Protocol      string `json:"protocol"`
+	RemotePort    int    `json:"remote_port"`
+	Compression   string `json:"compression,omitempty"` // Data stream compression: snappy, zstd
+	UseEncryption bool   `json:"use_encryption,omitempty"`
+	SecretKey     string `json:"secret_key,omitempty"` // Required by visitors of secret tunnels
+	Replace       bool   `json:"replace,omitempty"`    // Update the tunnel of this name registered by the same session
+
+	// HTTP tunnel options, applied by the server
+	CustomDomains     []string    `json:"custom_domains,omitempty"`
+	Locations         []string    `json:"locations,omitempty"`
+	StripLocation     bool        `json:"strip_location,omitempty"`
+	HostHeaderRewrite string      `json:"host_header_rewrite,omitempty"`
+	RequestHeaders    HeaderRules `json:"request_headers,omitempty"`
+	ResponseHeaders   HeaderRules `json:"response_headers,omitempty"`
+	HTTPUser          string      `json:"http_user,omitempty"`
+	HTTPPassword      string      `json:"http_password,omitempty"`
+	BearerTokens      []string    `json:"bearer_tokens,omitempty"`
+}
+
+// HeaderRules sets and removes HTTP headers on requests or responses.
+type HeaderRules struct {
+	Set    map[string]string `json:"set,omitempty"`
+	Remove []string          `json:"remove,omitempty"`
 }
 
 type RegTunnelResponse struct {
+	ID         uint64 `json:"id,omitempty"` // Of the request answered
 	Name       string `json:"name"`
 	Success    bool   `json:"success"`
 	RemotePort int    `json:"remote_port"` // Assigned port
 	Error      string `json:"error,omitempty"`
 }
 
+// UnregTunnelRequest releases a tunnel the same session registered, closing its public port.
+type UnregTunnelRequest struct {
+	ID   uint64 `json:"id,omitempty"`
+	Name string `json:"name"`
+}
+
 type NewConnRequest struct {
 	ConnID     string `json:"conn_id"`
 	TunnelName string `json:"tunnel_name"`
@@ -54,6 +110,43 @@ type ProxyDataRequest struct {
 	ConnID string `json:"conn_id"`
 }
 
+// PoolConnRequest parks an idle data connection on the server for the given session.
+// The server later sends TypeStartWork (with a NewConnRequest payload) on it.
+type PoolConnRequest struct {
+	SessionID string `json:"session_id"`
+}
+
+// VisitorRequest asks the server to splice a data connection to a secret tunnel.
+// Signature proves knowledge of the tunnel's secret key without sending it.
+type VisitorRequest struct {
+	ServerName string `json:"server_name"`
+	Timestamp  int64  `json:"timestamp"` // Unix seconds
+	Nonce      string `json:"nonce"`     // Random, accepted once, so captured requests cannot be replayed
+	Signature  string `json:"signature"`
+}
+
+// VisitorResponse tells the visitor how to wrap the data stream that follows,
+// the settings of the secret tunnel keyed with its secret key.
+type VisitorResponse struct {
+	Success       bool   `json:"success"`
+	Error         string `json:"error,omitempty"`
+	Compression   string `json:"compression,omitempty"`
+	UseEncryption bool   `json:"use_encryption,omitempty"`
+}
+
+// SignVisitor computes the VisitorRequest signature for a secret tunnel.
+func SignVisitor(secretKey, serverName string, timestamp int64, nonce string) string {
+	mac := hmac.New(sha256.New, []byte(secretKey))
+	mac.Write([]byte(serverName + ":" + strconv.FormatInt(timestamp, 10) + ":" + nonce))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VisitorStreamID is the transport.Options ConnID of the data stream opened by a
+// visitor request with nonce.
+func VisitorStreamID(nonce string) string {
+	return "visitor/" + nonce
+}
+
 // Helper to read JSON message from connection
 func ReadMessage(r io.Reader) (*Message, error) {
 	var msg Message
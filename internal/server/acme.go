@@ -0,0 +1,217 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const (
+	defaultACMECacheDir = "acme"
+	acmeRenewBefore     = 30 * 24 * time.Hour
+	acmeStatusRefresh   = 10 * time.Minute // How often renewals done by autocert are picked up for the dashboard
+)
+
+// acmeManager obtains and renews certificates for the custom domains of tunnels
+// through an ACME directory, answering HTTP-01 challenges on the vhost HTTP port.
+type acmeManager struct {
+	manager *autocert.Manager
+
+	mu     sync.Mutex
+	status map[string]*certStatus
+}
+
+// certStatus is the issuance state of one domain, shown in the dashboard.
+type certStatus struct {
+	Domain   string    `json:"domain"`
+	State    string    `json:"state"` // pending, valid or error
+	NotAfter time.Time `json:"not_after,omitempty"`
+	RenewAt  time.Time `json:"renew_at,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	Updated  time.Time `json:"updated"`
+}
+
+func (s *Server) newACMEManager() (*acmeManager, error) {
+	client := &acme.Client{DirectoryURL: s.Config.ACMEDirectoryURL}
+	if client.DirectoryURL == "" {
+		client.DirectoryURL = autocert.DefaultACMEDirectory
+	}
+	if s.Config.ACMECAFile != "" {
+		pem, err := os.ReadFile(s.Config.ACMECAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read acme_ca_file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", s.Config.ACMECAFile)
+		}
+		client.HTTPClient = &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	}
+
+	cacheDir := s.Config.ACMECacheDir
+	if cacheDir == "" {
+		cacheDir = defaultACMECacheDir
+	}
+
+	a := &acmeManager{status: make(map[string]*certStatus)}
+	a.manager = &autocert.Manager{
+		Prompt:      autocert.AcceptTOS,
+		Cache:       autocert.DirCache(cacheDir),
+		Email:       s.Config.ACMEEmail,
+		Client:      client,
+		RenewBefore: acmeRenewBefore,
+		HostPolicy: func(_ context.Context, host string) error {
+			if !s.vhost.hasDomain(host) {
+				return fmt.Errorf("%s is not a custom domain of any tunnel", host)
+			}
+			return nil
+		},
+	}
+	log.Printf("ACME enabled with directory %s", client.DirectoryURL)
+	return a, nil
+}
+
+// getCertificate returns the certificate for the handshake, issuing it first if needed.
+func (a *acmeManager) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	domain := normalizeHost(hello.ServerName)
+	a.mu.Lock()
+	if _, ok := a.status[domain]; !ok {
+		a.status[domain] = &certStatus{Domain: domain, State: "pending", Updated: time.Now()}
+	}
+	a.mu.Unlock()
+
+	cert, err := a.manager.GetCertificate(hello)
+	a.record(domain, cert, err)
+	return cert, err
+}
+
+func (a *acmeManager) record(domain string, cert *tls.Certificate, err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	st := &certStatus{Domain: domain, Updated: time.Now()}
+	if err != nil {
+		st.State = "error"
+		st.Error = err.Error()
+		if prev, ok := a.status[domain]; ok {
+			st.NotAfter, st.RenewAt = prev.NotAfter, prev.RenewAt
+		}
+	} else {
+		st.State = "valid"
+		if leaf, perr := x509.ParseCertificate(cert.Certificate[0]); perr == nil {
+			st.NotAfter = leaf.NotAfter
+			st.RenewAt = leaf.NotAfter.Add(-acmeRenewBefore)
+		}
+	}
+	a.status[domain] = st
+}
+
+// obtainCertificates requests certificates for newly registered domains in the
+// background. Domains with a user-supplied certificate are left alone, and
+// wildcard domains are skipped, since HTTP-01 cannot validate them.
+func (s *Server) obtainCertificates(domains []string) {
+	for _, d := range domains {
+		if strings.HasPrefix(d, "*.") || s.certs.match(d) != nil {
+			continue
+		}
+		s.acme.obtain(normalizeHost(d))
+	}
+}
+
+// ecdsaHello returns a ClientHelloInfo for domain as a current browser sends it.
+// autocert picks the key type from the hello, an empty one would get an RSA
+// certificate and the first real handshake a second, ECDSA one.
+func ecdsaHello(domain string) *tls.ClientHelloInfo {
+	return &tls.ClientHelloInfo{
+		ServerName:        domain,
+		SignatureSchemes:  []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+		SupportedCurves:   []tls.CurveID{tls.X25519, tls.CurveP256},
+		CipherSuites:      []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+		SupportedVersions: []uint16{tls.VersionTLS13, tls.VersionTLS12},
+	}
+}
+
+// obtain issues a certificate for domain in the background, unless one is
+// already valid or being issued.
+func (a *acmeManager) obtain(domain string) {
+	a.mu.Lock()
+	if st, ok := a.status[domain]; ok && st.State != "error" {
+		a.mu.Unlock()
+		return
+	}
+	a.status[domain] = &certStatus{Domain: domain, State: "pending", Updated: time.Now()}
+	a.mu.Unlock()
+
+	go func() {
+		if _, err := a.getCertificate(ecdsaHello(domain)); err != nil {
+			log.Printf("ACME certificate for %s failed: %v", domain, err)
+			return
+		}
+		log.Printf("ACME certificate for %s ready", domain)
+	}()
+}
+
+// valid reports whether a certificate was issued for host and has not expired.
+func (a *acmeManager) valid(host string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	st, ok := a.status[normalizeHost(host)]
+	return ok && !st.NotAfter.IsZero() && time.Now().Before(st.NotAfter)
+}
+
+// refreshStatuses updates the valid entries every acmeStatusRefresh, so renewals
+// done by autocert in the background show up. It never returns.
+func (a *acmeManager) refreshStatuses(vhost *vhostRouter) {
+	ticker := time.NewTicker(acmeStatusRefresh)
+	defer ticker.Stop()
+	for range ticker.C {
+		a.mu.Lock()
+		var refresh []string
+		for domain, st := range a.status {
+			if st.State == "valid" && vhost.hasDomain(domain) {
+				refresh = append(refresh, domain)
+			}
+		}
+		a.mu.Unlock()
+
+		// Valid certificates are served from memory, this does not contact the directory
+		// unless autocert decides a renewal is due.
+		for _, domain := range refresh {
+			cert, err := a.manager.GetCertificate(ecdsaHello(domain))
+			if err == nil {
+				a.record(domain, cert, nil)
+			}
+		}
+	}
+}
+
+// statuses lists the domains that are still routed. It never blocks on the
+// ACME directory, the entries are kept current by refreshStatuses.
+func (a *acmeManager) statuses(vhost *vhostRouter) []certStatus {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for domain := range a.status {
+		if !vhost.hasDomain(domain) {
+			delete(a.status, domain)
+		}
+	}
+	out := make([]certStatus, 0, len(a.status))
+	for _, st := range a.status {
+		out = append(out, *st)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Domain < out[j].Domain })
+	return out
+}
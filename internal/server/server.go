@@ -6,14 +6,21 @@ import (
 	"io"
 	"log"
 	"net"
+	"net/http/httputil"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"openproxy/internal/api"
+	"openproxy/internal/audit"
 	"openproxy/internal/config"
+	"openproxy/internal/conntrack"
+	"openproxy/internal/events"
 	"openproxy/internal/protocol"
+	"openproxy/internal/transport"
 )
 
 type Server struct {
@@ -24,6 +31,17 @@ type Server struct {
 	mu           sync.Mutex
 	pendingConns map[string]PendingConn
 	pendingMu    sync.Mutex
+	sessions     map[string]*Session
+	sessionsMu   sync.RWMutex
+	vhost        *vhostRouter
+	certs        *certStore
+	acme         *acmeManager
+	events       *events.Bus
+	conns        *conntrack.Registry // Public connections
+	Audit        *audit.Log          // Records client logins and registrations, nil disables it
+
+	visitorNonces map[string]time.Time // Nonces of accepted visitor requests, until their signature expires
+	visitorMu     sync.Mutex
 }
 
 type PendingConn struct {
@@ -31,18 +49,40 @@ type PendingConn struct {
 	Tunnel *Tunnel
 }
 
+// ProtocolSecret marks tunnels that are only reachable through visitors
+const ProtocolSecret = "secret"
+
 type TunnelManager struct {
 	tunnels map[string]*Tunnel
 	mu      sync.RWMutex
 }
 
 type Tunnel struct {
-	Name        string
-	Protocol    string
-	RemotePort  int
-	Listener    net.Listener
-	ControlConn net.Conn
-	ActiveConns int64
+	Name          string
+	Protocol      string
+	RemotePort    int
+	Compression   string
+	UseEncryption bool
+	SecretKey     string
+	Listener      net.Listener // nil for tunnels without a public port
+	ControlConn   net.Conn
+	Session       *Session
+	ActiveConns   int64
+	BytesIn       int64 // Read from public connections
+	BytesOut      int64 // Written to public connections
+
+	// HTTP tunnels only
+	CustomDomains     []string
+	Locations         []string
+	StripLocation     bool
+	HostHeaderRewrite string
+	RequestHeaders    protocol.HeaderRules
+	ResponseHeaders   protocol.HeaderRules
+	HTTPUser          string
+	HTTPPassword      string
+	BearerTokens      []string
+	AuthFailures      int64
+	httpProxy         *httputil.ReverseProxy
 }
 
 func NewServer(cfg *config.ServerConfig) *Server {
@@ -50,9 +90,18 @@ func NewServer(cfg *config.ServerConfig) *Server {
 		Config:       cfg,
 		tunnelMgr:    &TunnelManager{tunnels: make(map[string]*Tunnel)},
 		pendingConns: make(map[string]PendingConn),
+		sessions:     make(map[string]*Session),
+		vhost:        newVhostRouter(),
+		events:       events.NewBus(),
+		conns:        conntrack.NewRegistry(),
 	}
 }
 
+// Events returns the bus carrying live status changes for the Web UI.
+func (s *Server) Events() *events.Bus {
+	return s.events
+}
+
 func (s *Server) Start() error {
 	addr := fmt.Sprintf(":%d", s.Config.ControlPort)
 	ln, err := net.Listen("tcp", addr)
@@ -63,6 +112,33 @@ func (s *Server) Start() error {
 	s.running = true
 	log.Printf("Server listening on control port %d", s.Config.ControlPort)
 
+	go s.events.SampleTraffic(s.trafficSnapshot)
+	go s.conns.SampleRates()
+	if s.Config.TCPMuxPort > 0 {
+		go s.serveTCPMux()
+	}
+	if s.Config.VhostHTTPSPort > 0 {
+		s.certs = newCertStore(s.Config.TLSCertDir, s.Config.TLSCertFile, s.Config.TLSKeyFile)
+		if s.Config.ACMEEnabled && s.Config.VhostHTTPPort == 0 {
+			// HTTP-01 challenges are only answered on the vhost HTTP port
+			log.Printf("ACME disabled: vhost_http_port is not set")
+		} else if s.Config.ACMEEnabled {
+			acme, err := s.newACMEManager()
+			if err != nil {
+				log.Printf("ACME disabled: %v", err)
+			} else {
+				s.acme = acme
+				go acme.refreshStatuses(s.vhost)
+			}
+		}
+		go s.serveVhostHTTPS()
+	} else if s.Config.ACMEEnabled {
+		log.Printf("ACME disabled: vhost_https_port is not set")
+	}
+	if s.Config.VhostHTTPPort > 0 {
+		go s.serveVhostHTTP()
+	}
+
 	for s.running {
 		conn, err := s.listener.Accept()
 		if err != nil {
@@ -87,17 +163,31 @@ func (s *Server) Stop() {
 }
 
 func (s *Server) handleControlConnection(conn net.Conn) {
-	defer conn.Close()
+	keepOpen := false
+	defer func() {
+		if !keepOpen {
+			conn.Close()
+		}
+	}()
 	log.Printf("New control connection from %s", conn.RemoteAddr())
 
 	// 1. Auth
-	if err := s.handshake(conn); err != nil {
+	decoder := json.NewDecoder(conn)
+	sess, err := s.handshake(conn, decoder)
+	if err != nil {
 		log.Printf("Handshake failed: %v", err)
+		s.events.Publish(events.Error, map[string]interface{}{
+			"message":     fmt.Sprintf("Handshake failed: %v", err),
+			"remote_addr": conn.RemoteAddr().String(),
+		})
 		return
 	}
+	if sess != nil {
+		defer s.removeSession(sess)
+		go s.keepAlive(sess)
+	}
 
 	// 2. Loop for commands (Register Tunnel, Ping, etc.)
-	decoder := json.NewDecoder(conn)
 	for {
 		var msg protocol.Message
 		if err := decoder.Decode(&msg); err != nil {
@@ -106,6 +196,9 @@ func (s *Server) handleControlConnection(conn net.Conn) {
 			}
 			return
 		}
+		if sess != nil {
+			sess.touch()
+		}
 
 		switch msg.Type {
 		case protocol.TypeRegTunnel:
@@ -114,17 +207,53 @@ func (s *Server) handleControlConnection(conn net.Conn) {
 				log.Printf("Invalid reg payload: %v", err)
 				continue
 			}
-			s.handleRegisterTunnel(conn, req)
+			if sess == nil {
+				log.Printf("Tunnel registration on data connection from %s", conn.RemoteAddr())
+				return
+			}
+			s.handleRegisterTunnel(sess, req)
+		case protocol.TypeUnregTunnel:
+			var req protocol.UnregTunnelRequest
+			if err := json.Unmarshal(msg.Payload, &req); err != nil {
+				log.Printf("Invalid unreg payload: %v", err)
+				continue
+			}
+			if sess == nil {
+				log.Printf("Tunnel unregistration on data connection from %s", conn.RemoteAddr())
+				return
+			}
+			s.handleUnregisterTunnel(sess, req)
 		case protocol.TypePing:
-			protocol.WriteMessage(conn, protocol.TypePong, nil)
+			// Echo the payload so the client can measure the round-trip time
+			protocol.WriteMessage(conn, protocol.TypePong, msg.Payload)
+		case protocol.TypePong:
+			if sess != nil {
+				sess.handlePong(msg.Payload)
+			}
 		case protocol.TypeProxyData:
 			var req protocol.ProxyDataRequest
 			if err := json.Unmarshal(msg.Payload, &req); err != nil {
 				log.Printf("Invalid proxy data payload: %v", err)
 				return
 			}
-			s.handleProxyData(conn, req)
+			s.handleProxyData(transport.AfterMessages(conn, decoder), req)
 			return // This connection is now used for data, stop control loop
+		case protocol.TypePoolConn:
+			var req protocol.PoolConnRequest
+			if err := json.Unmarshal(msg.Payload, &req); err != nil {
+				log.Printf("Invalid pool conn payload: %v", err)
+				return
+			}
+			keepOpen = s.handlePoolConn(transport.AfterMessages(conn, decoder), req)
+			return // Parked until a public connection arrives
+		case protocol.TypeVisitor:
+			var req protocol.VisitorRequest
+			if err := json.Unmarshal(msg.Payload, &req); err != nil {
+				log.Printf("Invalid visitor payload: %v", err)
+				return
+			}
+			keepOpen = s.handleVisitor(transport.AfterMessages(conn, decoder), req)
+			return // Spliced to the secret tunnel like a public connection
 		}
 	}
 }
@@ -141,96 +270,377 @@ func (s *Server) handleProxyData(clientConn net.Conn, req protocol.ProxyDataRequ
 		log.Printf("Pending connection %s not found", req.ConnID)
 		return
 	}
-	publicConn := pc.Conn
-	tunnel := pc.Tunnel
+	s.bridge(pc.Tunnel, req.ConnID, pc.Conn, clientConn)
+}
 
+// bridge copies data between a public connection and a client data connection until either side closes.
+func (s *Server) bridge(tunnel *Tunnel, connID string, publicConn, clientConn net.Conn) {
 	defer func() {
 		publicConn.Close()
-		atomic.AddInt64(&tunnel.ActiveConns, -1)
+		clientConn.Close()
+		s.closeConn(tunnel, connID)
 	}()
 
+	clientConn, err := transport.Wrap(clientConn, transport.Options{
+		Compression: tunnel.Compression,
+		Encryption:  tunnel.UseEncryption,
+		Token:       s.Config.Token,
+		ConnID:      connID,
+	})
+	if err != nil {
+		log.Printf("Failed to set up data stream %s: %v", connID, err)
+		return
+	}
+
 	// Bridge connections
-	log.Printf("Bridging connection %s", req.ConnID)
+	s.conns.SetState(connID, api.ConnActive)
+	log.Printf("Bridging connection %s", connID)
+	publicConn = transport.CountBytes(publicConn, &tunnel.BytesIn, &tunnel.BytesOut)
 	go io.Copy(publicConn, clientConn)
 	io.Copy(clientConn, publicConn)
 }
 
-func (s *Server) handshake(conn net.Conn) error {
+// closeConn accounts for a public connection of t that has ended.
+func (s *Server) closeConn(t *Tunnel, connID string) {
+	atomic.AddInt64(&t.ActiveConns, -1)
+	s.conns.Remove(connID)
+	s.events.Publish(events.ConnClose, map[string]interface{}{
+		"conn_id": connID,
+		"tunnel":  t.Name,
+	})
+}
+
+// handshake authenticates a new connection. Control connections get a session,
+// data connections return a nil session.
+func (s *Server) handshake(conn net.Conn, decoder *json.Decoder) (*Session, error) {
 	var msg protocol.Message
-	decoder := json.NewDecoder(conn)
 	if err := decoder.Decode(&msg); err != nil {
-		return err
+		return nil, err
 	}
 
 	if msg.Type != protocol.TypeAuth {
-		return fmt.Errorf("unexpected message type: %s", msg.Type)
+		return nil, fmt.Errorf("unexpected message type: %s", msg.Type)
 	}
 
 	var req protocol.AuthRequest
 	if err := json.Unmarshal(msg.Payload, &req); err != nil {
-		return err
+		return nil, err
 	}
 
 	if req.Token != s.Config.Token {
 		protocol.WriteMessage(conn, protocol.TypeAuthResp, protocol.AuthResponse{Success: false, Error: "Invalid Token"})
-		return fmt.Errorf("invalid token")
+		// Limited per source, anyone reaching the control port can fail to authenticate
+		sourceIP := audit.SourceIP(conn.RemoteAddr().String())
+		s.Audit.RecordLimited(api.AuditClientAuth+":"+sourceIP, api.AuditEntry{
+			Action:   api.AuditClientAuth,
+			SourceIP: sourceIP,
+			Message:  "invalid token",
+		})
+		return nil, fmt.Errorf("invalid token")
+	}
+
+	if req.ConnType == protocol.ConnTypeData {
+		return nil, protocol.WriteMessage(conn, protocol.TypeAuthResp, protocol.AuthResponse{Success: true})
 	}
 
-	return protocol.WriteMessage(conn, protocol.TypeAuthResp, protocol.AuthResponse{Success: true})
+	sess := s.newSession(conn, req.HeartbeatInterval)
+	resp := protocol.AuthResponse{
+		Success:           true,
+		SessionID:         sess.ID,
+		MaxPoolCount:      s.maxPoolCount(),
+		HeartbeatInterval: int(sess.HeartbeatInterval / time.Second),
+		HeartbeatTimeout:  int(sess.HeartbeatTimeout / time.Second),
+	}
+	if err := protocol.WriteMessage(conn, protocol.TypeAuthResp, resp); err != nil {
+		s.removeSession(sess)
+		return nil, err
+	}
+	// Data connections are not recorded, there is one for every proxied connection
+	s.Audit.Record(api.AuditEntry{
+		Action:   api.AuditClientAuth,
+		SourceIP: audit.SourceIP(conn.RemoteAddr().String()),
+		Target:   sess.ID,
+		Success:  true,
+	})
+	return sess, nil
 }
 
-func (s *Server) handleRegisterTunnel(controlConn net.Conn, req protocol.RegTunnelRequest) {
-	// Validate Port Range
-	if s.Config.PortRange != "" {
-		parts := strings.Split(s.Config.PortRange, "-")
-		if len(parts) == 2 {
-			min, _ := strconv.Atoi(parts[0])
-			max, _ := strconv.Atoi(parts[1])
-			if req.RemotePort < min || req.RemotePort > max {
-				resp := protocol.RegTunnelResponse{
-					Name:       req.Name,
-					Success:    false,
-					Error:      fmt.Sprintf("Port %d is out of allowed range %s", req.RemotePort, s.Config.PortRange),
+func (s *Server) handleRegisterTunnel(sess *Session, req protocol.RegTunnelRequest) {
+	controlConn := sess.ControlConn
+	reject := func(format string, args ...interface{}) {
+		resp := protocol.RegTunnelResponse{
+			ID:      req.ID,
+			Name:    req.Name,
+			Success: false,
+			Error:   fmt.Sprintf(format, args...),
+		}
+		protocol.WriteMessage(controlConn, protocol.TypeRegResp, resp)
+		s.events.Publish(events.Error, map[string]interface{}{
+			"message": fmt.Sprintf("Tunnel %s rejected: %s", req.Name, resp.Error),
+			"tunnel":  req.Name,
+			"session": sess.ID,
+		})
+		s.Audit.Record(api.AuditEntry{
+			Action:   api.AuditTunnelRegister,
+			Actor:    "session:" + sess.ID,
+			SourceIP: audit.SourceIP(controlConn.RemoteAddr().String()),
+			Target:   req.Name,
+			Message:  resp.Error,
+		})
+	}
+
+	if !transport.ValidCompression(req.Compression) {
+		reject("Unsupported compression %s", req.Compression)
+		return
+	}
+
+	if len(req.CustomDomains) > 0 {
+		if req.Protocol != ProtocolHTTP {
+			reject("Custom domains require protocol http")
+			return
+		}
+		if s.Config.VhostHTTPPort == 0 && s.Config.VhostHTTPSPort == 0 {
+			reject("Server has no vhost_http_port or vhost_https_port for custom domains")
+			return
+		}
+		req.Locations = normalizeLocations(req.Locations)
+	} else if len(req.Locations) > 0 {
+		reject("Locations require custom domains")
+		return
+	}
+	if req.Protocol != ProtocolHTTP && (req.HTTPUser != "" || len(req.BearerTokens) > 0) {
+		reject("HTTP auth requires protocol http")
+		return
+	}
+	// Empty credentials would let requests without any through
+	if req.HTTPUser != "" && req.HTTPPassword == "" {
+		reject("http_user requires an http_password")
+		return
+	}
+	if slices.Contains(req.BearerTokens, "") {
+		reject("Bearer tokens cannot be empty")
+		return
+	}
+
+	// A session may replace its own tunnel to apply changed settings
+	s.tunnelMgr.mu.RLock()
+	old := s.tunnelMgr.tunnels[req.Name]
+	s.tunnelMgr.mu.RUnlock()
+	if old != nil && (!req.Replace || old.Session != sess) {
+		reject("Tunnel %s is already registered", req.Name)
+		return
+	}
+
+	var ln net.Listener
+	reused := false // Whether ln is still served for old
+	if req.Protocol == ProtocolSecret {
+		// Secret tunnels have no public port, they are only reachable by visitors
+		if req.SecretKey == "" {
+			reject("Secret tunnel %s requires a secret key", req.Name)
+			return
+		}
+		req.RemotePort = 0
+	} else if req.Protocol == ProtocolTCPMux {
+		// Reached through the shared tcpmux port by tunnel name
+		if s.Config.TCPMuxPort == 0 {
+			reject("Server has no tcpmux_port for tcpmux tunnels")
+			return
+		}
+		req.RemotePort = 0
+	} else if req.Protocol == ProtocolHTTP && req.RemotePort == 0 && len(req.CustomDomains) > 0 {
+		// Only reachable through the vhost port
+	} else if old != nil && old.Listener != nil && old.RemotePort == req.RemotePort {
+		// Keep the public port open, the listener passes to the new tunnel
+		if (old.Protocol == ProtocolHTTP) != (req.Protocol == ProtocolHTTP) {
+			reject("Tunnel %s cannot change between http and other protocols on the same port", req.Name)
+			return
+		}
+		ln = old.Listener
+		reused = true
+	} else {
+		// Validate Port Range
+		if s.Config.PortRange != "" {
+			parts := strings.Split(s.Config.PortRange, "-")
+			if len(parts) == 2 {
+				min, _ := strconv.Atoi(parts[0])
+				max, _ := strconv.Atoi(parts[1])
+				if req.RemotePort < min || req.RemotePort > max {
+					reject("Port %d is out of allowed range %s", req.RemotePort, s.Config.PortRange)
+					return
 				}
-				protocol.WriteMessage(controlConn, protocol.TypeRegResp, resp)
-				return
 			}
 		}
+
+		// Start listener for this tunnel
+		var err error
+		ln, err = net.Listen("tcp", fmt.Sprintf(":%d", req.RemotePort))
+		if err != nil {
+			reject("%s", err.Error())
+			return
+		}
+	}
+
+	t := &Tunnel{
+		Name:          req.Name,
+		Protocol:      req.Protocol,
+		RemotePort:    req.RemotePort,
+		Compression:   req.Compression,
+		UseEncryption: req.UseEncryption,
+		SecretKey:     req.SecretKey,
+		Listener:      ln,
+		ControlConn:   controlConn,
+		Session:       sess,
+
+		CustomDomains:     req.CustomDomains,
+		Locations:         req.Locations,
+		StripLocation:     req.StripLocation,
+		HostHeaderRewrite: req.HostHeaderRewrite,
+		RequestHeaders:    req.RequestHeaders,
+		ResponseHeaders:   req.ResponseHeaders,
+		HTTPUser:          req.HTTPUser,
+		HTTPPassword:      req.HTTPPassword,
+		BearerTokens:      req.BearerTokens,
+	}
+	if t.Protocol == ProtocolHTTP {
+		t.httpProxy = s.newHTTPProxy(t)
+	}
+
+	s.tunnelMgr.mu.Lock()
+	current := s.tunnelMgr.tunnels[req.Name]
+	if current == old {
+		s.tunnelMgr.tunnels[req.Name] = t
+	}
+	s.tunnelMgr.mu.Unlock()
+	if current != old {
+		if ln != nil && !reused {
+			ln.Close()
+		}
+		reject("Tunnel %s is already registered", req.Name)
+		return
+	}
+	if old != nil {
+		s.vhost.remove(old)
+	}
+
+	if len(t.CustomDomains) > 0 {
+		if err := s.vhost.add(t); err != nil {
+			s.tunnelMgr.mu.Lock()
+			if old != nil {
+				s.tunnelMgr.tunnels[req.Name] = old
+				s.vhost.add(old)
+			} else {
+				delete(s.tunnelMgr.tunnels, req.Name)
+			}
+			s.tunnelMgr.mu.Unlock()
+			if ln != nil && !reused {
+				ln.Close()
+			}
+			reject("%s", err.Error())
+			return
+		}
+		if s.acme != nil {
+			s.obtainCertificates(t.CustomDomains)
+		}
+	}
+
+	verb := "registered"
+	if old != nil {
+		// Connections already open finish on the old tunnel, the totals carry over
+		atomic.AddInt64(&t.BytesIn, atomic.LoadInt64(&old.BytesIn))
+		atomic.AddInt64(&t.BytesOut, atomic.LoadInt64(&old.BytesOut))
+		if old.Listener != nil && !reused {
+			old.Listener.Close()
+		}
+		verb = "updated"
 	}
 
-	// Start listener for this tunnel
-	addr := fmt.Sprintf(":%d", req.RemotePort)
-	ln, err := net.Listen("tcp", addr)
-	
 	resp := protocol.RegTunnelResponse{
+		ID:         req.ID,
 		Name:       req.Name,
 		RemotePort: req.RemotePort,
 		Success:    true,
 	}
+	protocol.WriteMessage(controlConn, protocol.TypeRegResp, resp)
+	s.events.Publish(events.TunnelRegister, map[string]interface{}{
+		"name":           t.Name,
+		"protocol":       t.Protocol,
+		"remote_port":    t.RemotePort,
+		"custom_domains": t.CustomDomains,
+		"session":        sess.ID,
+		"replaced":       old != nil,
+	})
+	registration := fmt.Sprintf("%s, protocol %s, remote port %d", verb, t.Protocol, t.RemotePort)
+	if len(t.CustomDomains) > 0 {
+		registration += ", domains " + strings.Join(t.CustomDomains, ", ")
+	}
+	s.Audit.Record(api.AuditEntry{
+		Action:   api.AuditTunnelRegister,
+		Actor:    "session:" + sess.ID,
+		SourceIP: audit.SourceIP(controlConn.RemoteAddr().String()),
+		Target:   t.Name,
+		Success:  true,
+		Message:  registration,
+	})
 
-	if err != nil {
-		resp.Success = false
-		resp.Error = err.Error()
-		protocol.WriteMessage(controlConn, protocol.TypeRegResp, resp)
+	if len(t.CustomDomains) > 0 {
+		log.Printf("Tunnel %s %s for domains %s, locations %s", req.Name, verb, strings.Join(t.CustomDomains, ", "), strings.Join(t.Locations, ", "))
+	}
+	if ln == nil {
+		if len(t.CustomDomains) == 0 {
+			log.Printf("Tunnel %s %s (%s)", req.Name, verb, req.Protocol)
+		}
+		return
+	}
+	log.Printf("Tunnel %s %s on port %d", req.Name, verb, req.RemotePort)
+	if reused {
 		return
 	}
 
-	t := &Tunnel{
-		Name:        req.Name,
-		Protocol:    req.Protocol,
-		RemotePort:  req.RemotePort,
-		Listener:    ln,
-		ControlConn: controlConn,
+	// Accept public connections for this tunnel
+	if t.Protocol == ProtocolHTTP {
+		go s.serveTunnelHTTP(t)
+	} else {
+		go s.acceptTunnelConnections(t)
 	}
+}
+
+// handleUnregisterTunnel releases a tunnel of sess, closing its public port. A
+// tunnel that is not registered counts as released, so clients can remove
+// tunnels whose registration failed.
+func (s *Server) handleUnregisterTunnel(sess *Session, req protocol.UnregTunnelRequest) {
+	resp := protocol.RegTunnelResponse{ID: req.ID, Name: req.Name, Success: true}
 	s.tunnelMgr.mu.Lock()
-	s.tunnelMgr.tunnels[req.Name] = t
+	t := s.tunnelMgr.tunnels[req.Name]
+	if t != nil && t.Session != sess {
+		resp.Success = false
+		resp.Error = fmt.Sprintf("Tunnel %s is registered by another client", req.Name)
+	} else if t != nil {
+		// The listener is not shared, tunnels replaced in place hand it over
+		if t.Listener != nil {
+			t.Listener.Close()
+		}
+		s.vhost.remove(t)
+		delete(s.tunnelMgr.tunnels, req.Name)
+	}
 	s.tunnelMgr.mu.Unlock()
 
-	protocol.WriteMessage(controlConn, protocol.TypeRegResp, resp)
-	log.Printf("Tunnel %s registered on port %d", req.Name, req.RemotePort)
-
-	// Accept public connections for this tunnel
-	go s.acceptTunnelConnections(t)
+	protocol.WriteMessage(sess.ControlConn, protocol.TypeRegResp, resp)
+	if t == nil {
+		return
+	}
+	s.Audit.Record(api.AuditEntry{
+		Action:   api.AuditTunnelUnregister,
+		Actor:    "session:" + sess.ID,
+		SourceIP: audit.SourceIP(sess.ControlConn.RemoteAddr().String()),
+		Target:   req.Name,
+		Success:  resp.Success,
+		Message:  resp.Error,
+	})
+	if !resp.Success {
+		return
+	}
+	log.Printf("Tunnel %s unregistered", req.Name)
+	s.events.Publish(events.TunnelUnregister, map[string]interface{}{"name": req.Name, "session": sess.ID})
 }
 
 func (s *Server) acceptTunnelConnections(t *Tunnel) {
@@ -242,14 +652,51 @@ func (s *Server) acceptTunnelConnections(t *Tunnel) {
 			return
 		}
 		
-		go s.handlePublicConnection(t, publicConn)
+		go s.handlePublicConnection(s.listenerOwner(t), publicConn)
 	}
 }
 
+// listenerOwner returns the tunnel now serving the listener t was registered with.
+// A tunnel updated without changing its port takes over the listener of t.
+func (s *Server) listenerOwner(t *Tunnel) *Tunnel {
+	s.tunnelMgr.mu.RLock()
+	defer s.tunnelMgr.mu.RUnlock()
+	if current := s.tunnelMgr.tunnels[t.Name]; current != nil && current.Listener == t.Listener {
+		return current
+	}
+	return t
+}
+
 func (s *Server) handlePublicConnection(t *Tunnel, publicConn net.Conn) {
 	atomic.AddInt64(&t.ActiveConns, 1)
 	
-	connID := fmt.Sprintf("%d", time.Now().UnixNano())
+	connID := newConnID()
+	tracked := s.conns.Add(api.Connection{
+		ID:         connID,
+		Tunnel:     t.Name,
+		RemoteAddr: publicConn.RemoteAddr().String(),
+		StartTime:  time.Now(),
+		State:      api.ConnPending,
+	}, publicConn)
+	publicConn = tracked.Count(publicConn)
+	s.events.Publish(events.ConnOpen, map[string]interface{}{
+		"conn_id":     connID,
+		"tunnel":      t.Name,
+		"remote_addr": publicConn.RemoteAddr().String(),
+	})
+	req := protocol.NewConnRequest{
+		ConnID:     connID,
+		TunnelName: t.Name,
+	}
+
+	// Prefer an idle pooled data connection, it saves the round trips of opening a new one
+	if t.Session != nil {
+		if workConn := s.takePoolConn(t.Session, req); workConn != nil {
+			log.Printf("New public connection on %s (ID: %s), using pooled connection", t.Name, connID)
+			s.bridge(t, connID, publicConn, workConn)
+			return
+		}
+	}
 
 	// Store pending connection
 	s.pendingMu.Lock()
@@ -257,18 +704,13 @@ func (s *Server) handlePublicConnection(t *Tunnel, publicConn net.Conn) {
 	s.pendingMu.Unlock()
 	
 	// Notify client to open a new connection for data
-	req := protocol.NewConnRequest{
-		ConnID:     connID,
-		TunnelName: t.Name,
-	}
-
 	if err := protocol.WriteMessage(t.ControlConn, protocol.TypeNewConn, req); err != nil {
 		log.Printf("Failed to notify client of new connection: %v", err)
 		s.pendingMu.Lock()
 		delete(s.pendingConns, connID)
 		s.pendingMu.Unlock()
 		publicConn.Close()
-		atomic.AddInt64(&t.ActiveConns, -1)
+		s.closeConn(t, connID)
 		return
 	}
 	
@@ -280,8 +722,12 @@ func (s *Server) handlePublicConnection(t *Tunnel, publicConn net.Conn) {
 		if pc, ok := s.pendingConns[connID]; ok {
 			pc.Conn.Close()
 			delete(s.pendingConns, connID)
-			atomic.AddInt64(&pc.Tunnel.ActiveConns, -1)
+			s.closeConn(pc.Tunnel, connID)
 			log.Printf("Connection %s timed out waiting for client", connID)
+			s.events.Publish(events.Error, map[string]interface{}{
+				"message": fmt.Sprintf("Connection %s timed out waiting for client", connID),
+				"tunnel":  pc.Tunnel.Name,
+			})
 		}
 		s.pendingMu.Unlock()
 	})
@@ -294,24 +740,147 @@ func (s *Server) GetStatus() interface{} {
 	var tunnels []map[string]interface{}
 	for _, t := range s.tunnelMgr.tunnels {
 		tunnels = append(tunnels, map[string]interface{}{
-			"name": t.Name,
-			"protocol": t.Protocol,
-			"remote_port": t.RemotePort,
-			"active_conns": atomic.LoadInt64(&t.ActiveConns),
+			"name":           t.Name,
+			"protocol":       t.Protocol,
+			"remote_port":    t.RemotePort,
+			"active_conns":   atomic.LoadInt64(&t.ActiveConns),
+			"compression":    t.Compression,
+			"use_encryption": t.UseEncryption,
+			"custom_domains": t.CustomDomains,
+			"locations":      t.Locations,
+			"auth_failures":  atomic.LoadInt64(&t.AuthFailures),
+			"bytes_in":       atomic.LoadInt64(&t.BytesIn),
+			"bytes_out":      atomic.LoadInt64(&t.BytesOut),
 		})
 	}
+
+	s.sessionsMu.RLock()
+	var sessions []map[string]interface{}
+	for _, sess := range s.sessions {
+		sessions = append(sessions, map[string]interface{}{
+			"id":          sess.ID,
+			"remote_addr": sess.ControlConn.RemoteAddr().String(),
+			"start_time":  sess.StartTime,
+			"pool_idle":   sess.PoolIdle(),
+			"last_seen":   sess.LastSeen(),
+			"rtt_ms":      float64(sess.RTT().Microseconds()) / 1000,
+		})
+	}
+	s.sessionsMu.RUnlock()
+
 	return map[string]interface{}{
-		"mode": "server",
-		"control_port": s.Config.ControlPort,
+		"mode":          "server",
+		"control_port":  s.Config.ControlPort,
 		"tunnels_count": len(tunnels),
-		"tunnels": tunnels,
+		"tunnels":       tunnels,
+		"sessions":      sessions,
+		"certificates":  s.acme.statuses(s.vhost),
+	}
+}
+
+// trafficSnapshot reads the byte counters of every registered tunnel.
+func (s *Server) trafficSnapshot() []events.TunnelTraffic {
+	s.tunnelMgr.mu.RLock()
+	defer s.tunnelMgr.mu.RUnlock()
+
+	samples := make([]events.TunnelTraffic, 0, len(s.tunnelMgr.tunnels))
+	for _, t := range s.tunnelMgr.tunnels {
+		samples = append(samples, events.TunnelTraffic{
+			Name:        t.Name,
+			BytesIn:     atomic.LoadInt64(&t.BytesIn),
+			BytesOut:    atomic.LoadInt64(&t.BytesOut),
+			ActiveConns: atomic.LoadInt64(&t.ActiveConns),
+		})
+	}
+	return samples
+}
+
+func (s *Server) Tunnels() []api.Tunnel {
+	s.tunnelMgr.mu.RLock()
+	defer s.tunnelMgr.mu.RUnlock()
+
+	tunnels := make([]api.Tunnel, 0, len(s.tunnelMgr.tunnels))
+	for _, t := range s.tunnelMgr.tunnels {
+		tunnels = append(tunnels, api.Tunnel{
+			Name:          t.Name,
+			Protocol:      t.Protocol,
+			RemotePort:    t.RemotePort,
+			CustomDomains: t.CustomDomains,
+			Locations:     t.Locations,
+			Compression:   t.Compression,
+			UseEncryption: t.UseEncryption,
+			ActiveConns:   atomic.LoadInt64(&t.ActiveConns),
+			BytesIn:       atomic.LoadInt64(&t.BytesIn),
+			BytesOut:      atomic.LoadInt64(&t.BytesOut),
+			Session:       t.Session.ID,
+		})
 	}
+	return tunnels
+}
+
+func (s *Server) Sessions() []api.Session {
+	tunnels := make(map[string][]string)
+	s.tunnelMgr.mu.RLock()
+	for _, t := range s.tunnelMgr.tunnels {
+		tunnels[t.Session.ID] = append(tunnels[t.Session.ID], t.Name)
+	}
+	s.tunnelMgr.mu.RUnlock()
+
+	s.sessionsMu.RLock()
+	defer s.sessionsMu.RUnlock()
+	sessions := make([]api.Session, 0, len(s.sessions))
+	for _, sess := range s.sessions {
+		sessions = append(sessions, api.Session{
+			ID:         sess.ID,
+			RemoteAddr: sess.ControlConn.RemoteAddr().String(),
+			StartTime:  sess.StartTime,
+			LastSeen:   sess.LastSeen(),
+			RTTMs:      float64(sess.RTT().Microseconds()) / 1000,
+			PoolIdle:   sess.PoolIdle(),
+			Tunnels:    tunnels[sess.ID],
+		})
+	}
+	return sessions
+}
+
+func (s *Server) Connections() []api.Connection {
+	return s.conns.List()
+}
+
+// KillConnection closes a public connection, whether it is bridged or still
+// waiting for the client.
+func (s *Server) KillConnection(id string) error {
+	info, err := s.conns.Kill(id)
+	if err != nil {
+		return err
+	}
+	s.pendingMu.Lock()
+	pc, pending := s.pendingConns[id]
+	delete(s.pendingConns, id)
+	s.pendingMu.Unlock()
+	if pending {
+		s.closeConn(pc.Tunnel, id)
+	}
+	log.Printf("Connection %s on %s from %s killed", id, info.Tunnel, info.RemoteAddr)
+	return nil
 }
 
 func (s *Server) AddTunnel(t config.Tunnel) error {
 	return fmt.Errorf("server mode does not support adding tunnels manually")
 }
 
+func (s *Server) UpdateTunnel(t config.Tunnel) error {
+	return fmt.Errorf("server mode does not support changing tunnels manually")
+}
+
 func (s *Server) RemoveTunnel(name string) error {
 	return fmt.Errorf("server mode does not support removing tunnels manually")
 }
+
+func (s *Server) GetInspections(tunnel string) (interface{}, error) {
+	return nil, fmt.Errorf("server mode does not support request inspection")
+}
+
+func (s *Server) ReplayRequest(id uint64) (interface{}, error) {
+	return nil, fmt.Errorf("server mode does not support request inspection")
+}
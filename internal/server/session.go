@@ -0,0 +1,302 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"openproxy/internal/api"
+	"openproxy/internal/audit"
+	"openproxy/internal/events"
+	"openproxy/internal/protocol"
+)
+
+const (
+	// Default cap on idle pooled data connections per client session
+	defaultMaxPoolCount = 5
+
+	defaultHeartbeatInterval = 10 * time.Second
+	defaultHeartbeatTimeout  = 90 * time.Second
+	maxHeartbeatInterval     = 60 * time.Second // Longer intervals would let clients put off dead-session detection
+)
+
+// Session is an authenticated client control connection.
+type Session struct {
+	ID                string
+	ControlConn       net.Conn
+	StartTime         time.Time
+	HeartbeatInterval time.Duration
+	HeartbeatTimeout  time.Duration
+	poolMu            sync.Mutex
+	pool              []*pooledConn // Idle data connections parked by the client, oldest first
+	poolSize          int
+	done              chan struct{} // Closed by removeSession, under poolMu
+	lastSeen          int64         // Unix nanoseconds of the last message from the client
+	rtt               int64         // Last measured round-trip time in nanoseconds
+}
+
+// LastSeen returns when the client last sent a message on the control connection.
+func (sess *Session) LastSeen() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&sess.lastSeen))
+}
+
+// PoolIdle returns how many pooled data connections are parked.
+func (sess *Session) PoolIdle() int {
+	sess.poolMu.Lock()
+	defer sess.poolMu.Unlock()
+	return len(sess.pool)
+}
+
+// pooledConn is an idle data connection parked by the client.
+type pooledConn struct {
+	net.Conn
+	claimed bool          // Taken for a public connection, under the session's poolMu
+	dead    bool          // The client closed it, set before stopped is closed
+	stopped chan struct{} // Closed when watch returns
+}
+
+// RTT returns the last measured round-trip time to the client.
+func (sess *Session) RTT() time.Duration {
+	return time.Duration(atomic.LoadInt64(&sess.rtt))
+}
+
+func (sess *Session) touch() {
+	atomic.StoreInt64(&sess.lastSeen, time.Now().UnixNano())
+}
+
+func newSessionID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// newConnID returns a random connection ID. The keys of encrypted data streams
+// are derived from it, so it must not repeat, which timestamps do not ensure.
+func newConnID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func (s *Server) maxPoolCount() int {
+	if s.Config.MaxPoolCount > 0 {
+		return s.Config.MaxPoolCount
+	}
+	return defaultMaxPoolCount
+}
+
+// negotiateHeartbeat picks the ping interval requested by the client, at most
+// maxHeartbeatInterval, and a timeout that tolerates a few missed pings, never
+// shorter than the server's own setting.
+func (s *Server) negotiateHeartbeat(clientInterval int) (time.Duration, time.Duration) {
+	interval := defaultHeartbeatInterval
+	if clientInterval > 0 {
+		// Compared in seconds, large values would overflow a Duration
+		interval = maxHeartbeatInterval
+		if clientInterval < int(maxHeartbeatInterval/time.Second) {
+			interval = time.Duration(clientInterval) * time.Second
+		}
+	}
+	timeout := defaultHeartbeatTimeout
+	if s.Config.HeartbeatTimeout > 0 {
+		timeout = time.Duration(s.Config.HeartbeatTimeout) * time.Second
+	}
+	if timeout < 3*interval {
+		timeout = 3 * interval
+	}
+	return interval, timeout
+}
+
+func (s *Server) newSession(conn net.Conn, heartbeatInterval int) *Session {
+	interval, timeout := s.negotiateHeartbeat(heartbeatInterval)
+	sess := &Session{
+		ID:                newSessionID(),
+		ControlConn:       conn,
+		StartTime:         time.Now(),
+		HeartbeatInterval: interval,
+		HeartbeatTimeout:  timeout,
+		poolSize:          s.maxPoolCount(),
+		done:              make(chan struct{}),
+	}
+	sess.touch()
+	s.sessionsMu.Lock()
+	s.sessions[sess.ID] = sess
+	s.sessionsMu.Unlock()
+	s.events.Publish(events.ClientConnect, map[string]interface{}{
+		"session":     sess.ID,
+		"remote_addr": conn.RemoteAddr().String(),
+	})
+	return sess
+}
+
+func (s *Server) getSession(id string) *Session {
+	s.sessionsMu.RLock()
+	defer s.sessionsMu.RUnlock()
+	return s.sessions[id]
+}
+
+func (s *Server) removeSession(sess *Session) {
+	s.sessionsMu.Lock()
+	delete(s.sessions, sess.ID)
+	s.sessionsMu.Unlock()
+	// Under poolMu, so handlePoolConn does not park connections after the drain below
+	sess.poolMu.Lock()
+	close(sess.done)
+	pool := sess.pool
+	sess.pool = nil
+	sess.poolMu.Unlock()
+	s.events.Publish(events.ClientDisconnect, map[string]interface{}{
+		"session":     sess.ID,
+		"remote_addr": sess.ControlConn.RemoteAddr().String(),
+	})
+
+	// Release the tunnels of this session so their ports can be registered again
+	s.tunnelMgr.mu.Lock()
+	for name, t := range s.tunnelMgr.tunnels {
+		if t.Session == sess {
+			if t.Listener != nil {
+				t.Listener.Close()
+			}
+			s.vhost.remove(t)
+			delete(s.tunnelMgr.tunnels, name)
+			log.Printf("Tunnel %s unregistered", name)
+			s.events.Publish(events.TunnelUnregister, map[string]interface{}{"name": name})
+		}
+	}
+	s.tunnelMgr.mu.Unlock()
+
+	// Drop idle pooled connections, the client will open new ones when it reconnects
+	for _, pc := range pool {
+		pc.Close()
+	}
+}
+
+// handlePoolConn parks an idle data connection until a public connection needs it.
+// It reports whether the connection was kept.
+func (s *Server) handlePoolConn(conn net.Conn, req protocol.PoolConnRequest) bool {
+	sess := s.getSession(req.SessionID)
+	if sess == nil {
+		log.Printf("Pool connection for unknown session %s", req.SessionID)
+		return false
+	}
+
+	sess.poolMu.Lock()
+	defer sess.poolMu.Unlock()
+	select {
+	case <-sess.done:
+		log.Printf("Pool connection for closed session %s", sess.ID)
+		return false
+	default:
+	}
+	if len(sess.pool) >= sess.poolSize {
+		log.Printf("Pool of session %s is full, dropping connection", sess.ID)
+		return false
+	}
+	pc := &pooledConn{Conn: conn, stopped: make(chan struct{})}
+	sess.pool = append(sess.pool, pc)
+	go sess.watch(pc)
+	return true
+}
+
+// watch reads from a parked connection until it is claimed. The client sends
+// nothing before TypeStartWork, so a read that returns otherwise means the
+// client closed the connection, and it leaves the pool. Writes would not tell,
+// they succeed on half-open connections.
+func (sess *Session) watch(pc *pooledConn) {
+	defer close(pc.stopped)
+	var b [1]byte
+	_, err := pc.Read(b[:])
+
+	sess.poolMu.Lock()
+	if pc.claimed {
+		sess.poolMu.Unlock()
+		// takePoolConn ends the read with a deadline
+		if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+			pc.dead = true
+		}
+		return
+	}
+	for i, p := range sess.pool {
+		if p == pc {
+			sess.pool = append(sess.pool[:i], sess.pool[i+1:]...)
+			break
+		}
+	}
+	sess.poolMu.Unlock()
+	pc.Close()
+}
+
+// takePoolConn hands a public connection to an idle pooled data connection.
+// It returns the data connection, or nil if the pool is empty.
+func (s *Server) takePoolConn(sess *Session, req protocol.NewConnRequest) net.Conn {
+	for {
+		sess.poolMu.Lock()
+		if len(sess.pool) == 0 {
+			sess.poolMu.Unlock()
+			return nil
+		}
+		pc := sess.pool[0]
+		sess.pool = sess.pool[1:]
+		pc.claimed = true
+		sess.poolMu.Unlock()
+
+		// Stop watching, then hand the connection over
+		pc.SetReadDeadline(time.Now())
+		<-pc.stopped
+		if pc.dead {
+			pc.Close()
+			continue
+		}
+		pc.SetReadDeadline(time.Time{})
+		if err := protocol.WriteMessage(pc.Conn, protocol.TypeStartWork, req); err != nil {
+			log.Printf("Pooled connection of session %s is dead: %v", sess.ID, err)
+			pc.Close()
+			continue
+		}
+		return pc.Conn
+	}
+}
+
+// keepAlive pings the client and drops the session once it stops hearing from it,
+// so half-open control connections do not keep their tunnels forever.
+func (s *Server) keepAlive(sess *Session) {
+	ticker := time.NewTicker(sess.HeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-sess.done:
+			return
+		case <-ticker.C:
+			if time.Since(sess.LastSeen()) > sess.HeartbeatTimeout {
+				log.Printf("Session %s (%s) missed heartbeats for %s, closing", sess.ID, sess.ControlConn.RemoteAddr(), sess.HeartbeatTimeout)
+				s.Audit.Record(api.AuditEntry{
+					Action:   api.AuditSessionKick,
+					SourceIP: audit.SourceIP(sess.ControlConn.RemoteAddr().String()),
+					Target:   sess.ID,
+					Success:  true,
+					Message:  fmt.Sprintf("missed heartbeats for %s", sess.HeartbeatTimeout),
+				})
+				// Unblocks the control loop, which then removes the session
+				sess.ControlConn.Close()
+				return
+			}
+			protocol.WriteMessage(sess.ControlConn, protocol.TypePing, protocol.Ping{Timestamp: time.Now().UnixNano()})
+		}
+	}
+}
+
+// handlePong records the round-trip time of a ping sent by keepAlive.
+func (sess *Session) handlePong(payload json.RawMessage) {
+	var pong protocol.Ping
+	if err := json.Unmarshal(payload, &pong); err != nil || pong.Timestamp == 0 {
+		return
+	}
+	atomic.StoreInt64(&sess.rtt, time.Now().UnixNano()-pong.Timestamp)
+}
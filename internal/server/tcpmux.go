@@ -0,0 +1,76 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"openproxy/internal/transport"
+)
+
+// ProtocolTCPMux marks TCP tunnels that share the tcpmux port and are selected
+// with an HTTP CONNECT request naming the tunnel.
+const ProtocolTCPMux = "tcpmux"
+
+// tcpmuxHandshakeTimeout bounds how long a client may take to send its CONNECT request.
+const tcpmuxHandshakeTimeout = 10 * time.Second
+
+// serveTCPMux accepts connections on the shared tcpmux port.
+func (s *Server) serveTCPMux() {
+	addr := fmt.Sprintf(":%d", s.Config.TCPMuxPort)
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Printf("TCP mux error: %v", err)
+		return
+	}
+	log.Printf("TCP mux listening on %s", addr)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Printf("TCP mux accept error: %v", err)
+			return
+		}
+		go s.handleTCPMuxConn(conn)
+	}
+}
+
+// handleTCPMuxConn reads "CONNECT name:port HTTP/1.1" and hands the rest of the
+// connection to the tcpmux tunnel registered as name. The port is ignored.
+func (s *Server) handleTCPMuxConn(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(tcpmuxHandshakeTimeout))
+	br := bufio.NewReader(conn)
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	if req.Method != http.MethodConnect {
+		fmt.Fprint(conn, "HTTP/1.1 405 Method Not Allowed\r\nAllow: CONNECT\r\nContent-Length: 0\r\n\r\n")
+		conn.Close()
+		return
+	}
+
+	name := req.Host
+	if host, _, err := net.SplitHostPort(name); err == nil {
+		name = host
+	}
+	s.tunnelMgr.mu.RLock()
+	t, ok := s.tunnelMgr.tunnels[name]
+	s.tunnelMgr.mu.RUnlock()
+	if !ok || t.Protocol != ProtocolTCPMux {
+		log.Printf("TCP mux request for unknown tunnel %s from %s", name, conn.RemoteAddr())
+		fmt.Fprint(conn, "HTTP/1.1 404 Not Found\r\nContent-Length: 0\r\n\r\n")
+		conn.Close()
+		return
+	}
+
+	if _, err := fmt.Fprint(conn, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	s.handlePublicConnection(t, transport.AfterReader(conn, br))
+}
@@ -0,0 +1,204 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// certReloadInterval is how often the certificate directory is checked for changes.
+const certReloadInterval = 10 * time.Second
+
+// certStore serves certificates for the HTTPS vhost port. Certificates come from
+// <name>.crt/<name>.key pairs in a directory and are matched by the DNS names
+// they contain, falling back to a default certificate.
+type certStore struct {
+	dir      string
+	certFile string
+	keyFile  string
+
+	mu       sync.RWMutex
+	byName   map[string]*tls.Certificate
+	fallback *tls.Certificate
+	stamp    string // File names, sizes and modification times of the last load
+}
+
+func newCertStore(dir, certFile, keyFile string) *certStore {
+	cs := &certStore{dir: dir, certFile: certFile, keyFile: keyFile}
+	cs.reload()
+	if dir != "" || certFile != "" {
+		go cs.watch()
+	}
+	return cs
+}
+
+// watch reloads the certificates whenever one of the files changes.
+func (cs *certStore) watch() {
+	ticker := time.NewTicker(certReloadInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		cs.reload()
+	}
+}
+
+// files lists the certificate/key pairs of the store, default certificate first.
+func (cs *certStore) files() [][2]string {
+	var pairs [][2]string
+	if cs.certFile != "" {
+		pairs = append(pairs, [2]string{cs.certFile, cs.keyFile})
+	}
+	if cs.dir == "" {
+		return pairs
+	}
+	matches, _ := filepath.Glob(filepath.Join(cs.dir, "*.crt"))
+	sort.Strings(matches)
+	for _, crt := range matches {
+		pairs = append(pairs, [2]string{crt, strings.TrimSuffix(crt, ".crt") + ".key"})
+	}
+	return pairs
+}
+
+func (cs *certStore) reload() {
+	pairs := cs.files()
+
+	var stamp strings.Builder
+	for _, pair := range pairs {
+		for _, name := range pair {
+			if fi, err := os.Stat(name); err == nil {
+				fmt.Fprintf(&stamp, "%s:%d:%d;", name, fi.Size(), fi.ModTime().UnixNano())
+			}
+		}
+	}
+	cs.mu.RLock()
+	unchanged := stamp.String() == cs.stamp
+	cs.mu.RUnlock()
+	if unchanged {
+		return
+	}
+
+	byName := make(map[string]*tls.Certificate)
+	var fallback *tls.Certificate
+	for i, pair := range pairs {
+		cert, err := tls.LoadX509KeyPair(pair[0], pair[1])
+		if err != nil {
+			log.Printf("Failed to load certificate %s: %v", pair[0], err)
+			continue
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			log.Printf("Failed to parse certificate %s: %v", pair[0], err)
+			continue
+		}
+		cert.Leaf = leaf
+		if i == 0 && cs.certFile != "" {
+			fallback = &cert
+			continue
+		}
+		for _, name := range leaf.DNSNames {
+			byName[strings.ToLower(name)] = &cert
+		}
+	}
+
+	cs.mu.Lock()
+	cs.byName = byName
+	cs.fallback = fallback
+	cs.stamp = stamp.String()
+	cs.mu.Unlock()
+	log.Printf("Loaded %d certificate names for HTTPS vhost", len(byName))
+}
+
+// match returns the certificate issued for host by exact or wildcard name.
+func (cs *certStore) match(host string) *tls.Certificate {
+	host = normalizeHost(host)
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	if cert, ok := cs.byName[host]; ok {
+		return cert
+	}
+	if dot := strings.Index(host, "."); dot >= 0 {
+		if cert, ok := cs.byName["*"+host[dot:]]; ok {
+			return cert
+		}
+	}
+	return nil
+}
+
+// lookup returns the certificate for host, or the default certificate.
+func (cs *certStore) lookup(host string) *tls.Certificate {
+	if cert := cs.match(host); cert != nil {
+		return cert
+	}
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	return cs.fallback
+}
+
+// covers reports whether a certificate valid for host is available.
+func (cs *certStore) covers(host string) bool {
+	cert := cs.lookup(host)
+	return cert != nil && cert.Leaf.VerifyHostname(normalizeHost(host)) == nil
+}
+
+// getCertificate picks the certificate for a TLS handshake on the HTTPS vhost port:
+// a matching certificate from the store, then one issued via ACME, then the default.
+func (s *Server) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if cert := s.certs.match(hello.ServerName); cert != nil {
+		return cert, nil
+	}
+	if s.acme != nil && s.vhost.hasDomain(hello.ServerName) {
+		cert, err := s.acme.getCertificate(hello)
+		if err == nil {
+			return cert, nil
+		}
+		log.Printf("ACME certificate for %s unavailable: %v", hello.ServerName, err)
+	}
+	if cert := s.certs.lookup(hello.ServerName); cert != nil {
+		return cert, nil
+	}
+	return nil, fmt.Errorf("no certificate for %q", hello.ServerName)
+}
+
+// hasCertificate reports whether HTTPS requests for host can be served with a valid certificate.
+func (s *Server) hasCertificate(host string) bool {
+	return s.certs.covers(host) || (s.acme != nil && s.acme.valid(host))
+}
+
+// serveVhostHTTPS terminates TLS on the shared HTTPS vhost port and forwards
+// plain HTTP through the tunnels.
+func (s *Server) serveVhostHTTPS() {
+	addr := fmt.Sprintf(":%d", s.Config.VhostHTTPSPort)
+	log.Printf("HTTPS vhost listening on %s", addr)
+	srv := &http.Server{
+		Addr:      addr,
+		Handler:   s.vhostHandler(),
+		TLSConfig: &tls.Config{GetCertificate: s.getCertificate},
+	}
+	if err := srv.ListenAndServeTLS("", ""); err != nil {
+		log.Printf("HTTPS vhost error: %v", err)
+	}
+}
+
+// redirectHTTPS sends requests for hosts covered by a certificate to the HTTPS vhost port.
+func (s *Server) redirectHTTPS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.hasCertificate(r.Host) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		host := normalizeHost(r.Host)
+		if s.Config.VhostHTTPSPort != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(s.Config.VhostHTTPSPort))
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
@@ -0,0 +1,309 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"openproxy/internal/protocol"
+)
+
+// ProtocolHTTP marks tunnels whose traffic the server parses as HTTP
+const ProtocolHTTP = "http"
+
+// vhostRouter maps request hosts and path prefixes to HTTP tunnels.
+type vhostRouter struct {
+	mu     sync.RWMutex
+	routes map[string][]vhostRoute // Keyed by domain, longest location first
+}
+
+type vhostRoute struct {
+	location string
+	tunnel   *Tunnel
+}
+
+func newVhostRouter() *vhostRouter {
+	return &vhostRouter{routes: make(map[string][]vhostRoute)}
+}
+
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// normalizeLocations cleans path prefixes to "/a/b" form, defaulting to "/".
+func normalizeLocations(locations []string) []string {
+	if len(locations) == 0 {
+		return []string{"/"}
+	}
+	out := make([]string, 0, len(locations))
+	for _, loc := range locations {
+		loc = "/" + strings.Trim(loc, "/")
+		if !slices.Contains(out, loc) {
+			out = append(out, loc)
+		}
+	}
+	return out
+}
+
+// matchLocation reports whether path falls under the location prefix.
+// "/v1" matches "/v1" and "/v1/users" but not "/v10".
+func matchLocation(location, path string) bool {
+	if location == "/" || path == location {
+		return true
+	}
+	return strings.HasPrefix(path, location+"/")
+}
+
+// add routes every domain and location of t, or none of them if one is already taken.
+func (r *vhostRouter) add(t *Tunnel) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, d := range t.CustomDomains {
+		for _, rt := range r.routes[normalizeHost(d)] {
+			if slices.Contains(t.Locations, rt.location) {
+				return fmt.Errorf("domain %s location %s is already used by tunnel %s", d, rt.location, rt.tunnel.Name)
+			}
+		}
+	}
+	for _, d := range t.CustomDomains {
+		key := normalizeHost(d)
+		routes := r.routes[key]
+		for _, loc := range t.Locations {
+			routes = append(routes, vhostRoute{location: loc, tunnel: t})
+		}
+		sort.SliceStable(routes, func(i, j int) bool {
+			return len(routes[i].location) > len(routes[j].location)
+		})
+		r.routes[key] = routes
+	}
+	return nil
+}
+
+func (r *vhostRouter) remove(t *Tunnel) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for d, routes := range r.routes {
+		routes = slices.DeleteFunc(routes, func(rt vhostRoute) bool { return rt.tunnel == t })
+		if len(routes) == 0 {
+			delete(r.routes, d)
+		} else {
+			r.routes[d] = routes
+		}
+	}
+}
+
+// hasDomain reports whether host is routed by name, not only through a wildcard domain.
+func (r *vhostRouter) hasDomain(host string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	_, ok := r.routes[normalizeHost(host)]
+	return ok
+}
+
+// lookup finds the route with the longest location matching path on host,
+// falling back to wildcard domains like *.example.com.
+func (r *vhostRouter) lookup(host, path string) (vhostRoute, bool) {
+	host = normalizeHost(host)
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	key := host
+	for {
+		for _, rt := range r.routes[key] {
+			if matchLocation(rt.location, path) {
+				return rt, true
+			}
+		}
+		dot := strings.Index(host, ".")
+		if dot < 0 {
+			return vhostRoute{}, false
+		}
+		host = host[dot+1:]
+		key = "*." + host
+	}
+}
+
+// serveVhostHTTP serves the shared plain HTTP vhost port.
+func (s *Server) serveVhostHTTP() {
+	addr := fmt.Sprintf(":%d", s.Config.VhostHTTPPort)
+	log.Printf("HTTP vhost listening on %s", addr)
+	handler := s.vhostHandler()
+	if s.Config.HTTPSRedirect && s.certs != nil {
+		handler = s.redirectHTTPS(handler)
+	}
+	if s.acme != nil {
+		// Answers HTTP-01 challenges and passes everything else on
+		handler = s.acme.manager.HTTPHandler(handler)
+	}
+	if err := http.ListenAndServe(addr, handler); err != nil {
+		log.Printf("HTTP vhost error: %v", err)
+	}
+}
+
+// vhostHandler routes requests to tunnels by Host header and path.
+func (s *Server) vhostHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rt, ok := s.vhost.lookup(r.Host, r.URL.Path)
+		if !ok {
+			http.Error(w, "No tunnel for host "+r.Host, http.StatusNotFound)
+			return
+		}
+		if rt.tunnel.StripLocation && rt.location != "/" {
+			r = stripLocation(r, rt.location)
+		}
+		s.serveTunnelRequest(rt.tunnel, w, r)
+	})
+}
+
+// stripLocation returns a copy of r without the location prefix in its path.
+// The removed prefix is passed on in X-Forwarded-Prefix.
+func stripLocation(r *http.Request, location string) *http.Request {
+	r2 := r.Clone(r.Context())
+	r2.URL.Path = strings.TrimPrefix(r.URL.Path, location)
+	if r2.URL.Path == "" {
+		r2.URL.Path = "/"
+	}
+	if r.URL.RawPath != "" {
+		r2.URL.RawPath = strings.TrimPrefix(r.URL.RawPath, location)
+		if r2.URL.RawPath == "" {
+			r2.URL.RawPath = "/"
+		}
+	}
+	r2.Header.Set("X-Forwarded-Prefix", location)
+	return r2
+}
+
+// serveTunnelHTTP serves an HTTP tunnel on its own remote port.
+func (s *Server) serveTunnelHTTP(t *Tunnel) {
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.serveTunnelRequest(s.listenerOwner(t), w, r)
+	})}
+	if err := srv.Serve(t.Listener); err != nil {
+		log.Printf("Tunnel %s HTTP serve ended: %v", t.Name, err)
+	}
+}
+
+// serveTunnelRequest checks the edge credentials of t and forwards the request through the tunnel.
+func (s *Server) serveTunnelRequest(t *Tunnel, w http.ResponseWriter, r *http.Request) {
+	if !t.authorize(r) {
+		n := atomic.AddInt64(&t.AuthFailures, 1)
+		log.Printf("Tunnel %s rejected unauthorized request from %s (%d failures)", t.Name, r.RemoteAddr, n)
+		if t.HTTPUser != "" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="Restricted"`)
+		} else {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+		}
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	t.httpProxy.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), publicAddrKey{}, r.RemoteAddr)))
+}
+
+// authorize reports whether r carries valid basic auth or bearer credentials for t.
+// Tunnels without http_user or bearer_tokens are open. Credentials accepted here
+// are meant for the edge and are not passed on to the local service.
+func (t *Tunnel) authorize(r *http.Request) bool {
+	if t.HTTPUser == "" && len(t.BearerTokens) == 0 {
+		return true
+	}
+	if t.HTTPUser != "" {
+		u, p, ok := r.BasicAuth()
+		if ok && subtle.ConstantTimeCompare([]byte(u), []byte(t.HTTPUser)) == 1 && subtle.ConstantTimeCompare([]byte(p), []byte(t.HTTPPassword)) == 1 {
+			r.Header.Del("Authorization")
+			return true
+		}
+	}
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		for _, allowed := range t.BearerTokens {
+			if allowed != "" && subtle.ConstantTimeCompare([]byte(token), []byte(allowed)) == 1 {
+				r.Header.Del("Authorization")
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// publicAddrKey carries the address of the public client through the reverse proxy
+// to the stream it dials.
+type publicAddrKey struct{}
+
+type publicAddr string
+
+func (a publicAddr) Network() string { return "tcp" }
+func (a publicAddr) String() string  { return string(a) }
+
+// publicAddrConn is a tunnel stream of an HTTP tunnel. It reports the public client
+// whose request opened it, later requests may reuse the stream while it is idle.
+type publicAddrConn struct {
+	net.Conn
+	remote publicAddr
+}
+
+func (c publicAddrConn) RemoteAddr() net.Addr { return c.remote }
+
+// newHTTPProxy builds the reverse proxy that forwards parsed requests through tunnel t.
+func (s *Server) newHTTPProxy(t *Tunnel) *httputil.ReverseProxy {
+	transport := &http.Transport{
+		// Every upstream connection is a new stream through the tunnel
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			publicSide, tunnelSide := net.Pipe()
+			var conn net.Conn = tunnelSide
+			if remote, ok := ctx.Value(publicAddrKey{}).(string); ok {
+				conn = publicAddrConn{Conn: tunnelSide, remote: publicAddr(remote)}
+			}
+			go s.handlePublicConnection(t, conn)
+			return publicSide, nil
+		},
+		DisableCompression: true, // Leave content negotiation to the public client
+		// One stream per request, so the connections listed and counted are the
+		// requests in flight, each with the address of its own public client
+		DisableKeepAlives:     true,
+		ResponseHeaderTimeout: 60 * time.Second,
+	}
+
+	return &httputil.ReverseProxy{
+		Transport: transport,
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.Out.URL.Scheme = "http"
+			pr.Out.URL.Host = pr.In.Host
+			pr.SetXForwarded()
+			if ip, _, err := net.SplitHostPort(pr.In.RemoteAddr); err == nil {
+				pr.Out.Header.Set("X-Real-IP", ip)
+			}
+			if t.HostHeaderRewrite != "" {
+				pr.Out.Host = t.HostHeaderRewrite
+			}
+			applyHeaderRules(pr.Out.Header, t.RequestHeaders)
+		},
+		ModifyResponse: func(resp *http.Response) error {
+			applyHeaderRules(resp.Header, t.ResponseHeaders)
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Printf("Tunnel %s HTTP proxy error: %v", t.Name, err)
+			http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		},
+	}
+}
+
+func applyHeaderRules(h http.Header, rules protocol.HeaderRules) {
+	for _, name := range rules.Remove {
+		h.Del(name)
+	}
+	for name, value := range rules.Set {
+		h.Set(name, value)
+	}
+}
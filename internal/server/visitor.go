@@ -0,0 +1,86 @@
+package server
+
+import (
+	"crypto/hmac"
+	"log"
+	"net"
+	"time"
+
+	"openproxy/internal/protocol"
+	"openproxy/internal/transport"
+)
+
+// Visitor signatures older than this are rejected to limit replays
+const visitorMaxClockSkew = 5 * time.Minute
+
+// handleVisitor splices a visitor's data connection to the secret tunnel it asks for.
+// It reports whether the connection was handed over.
+func (s *Server) handleVisitor(conn net.Conn, req protocol.VisitorRequest) bool {
+	s.tunnelMgr.mu.RLock()
+	t, ok := s.tunnelMgr.tunnels[req.ServerName]
+	s.tunnelMgr.mu.RUnlock()
+
+	reject := func(reason string) bool {
+		log.Printf("Visitor from %s rejected for %s: %s", conn.RemoteAddr(), req.ServerName, reason)
+		protocol.WriteMessage(conn, protocol.TypeVisitorResp, protocol.VisitorResponse{Success: false, Error: reason})
+		return false
+	}
+
+	if !ok || t.Protocol != ProtocolSecret {
+		return reject("secret tunnel not found")
+	}
+
+	skew := time.Since(time.Unix(req.Timestamp, 0))
+	if skew > visitorMaxClockSkew || skew < -visitorMaxClockSkew {
+		return reject("signature expired")
+	}
+
+	expected := protocol.SignVisitor(t.SecretKey, req.ServerName, req.Timestamp, req.Nonce)
+	if !hmac.Equal([]byte(expected), []byte(req.Signature)) {
+		return reject("invalid secret key")
+	}
+	if req.Nonce == "" || !s.useVisitorNonce(req.Nonce, req.Timestamp) {
+		return reject("request already used")
+	}
+
+	resp := protocol.VisitorResponse{Success: true, Compression: t.Compression, UseEncryption: t.UseEncryption}
+	if err := protocol.WriteMessage(conn, protocol.TypeVisitorResp, resp); err != nil {
+		return false
+	}
+	// Keyed with the secret key, other clients of the server cannot read it
+	conn, err := transport.Wrap(conn, transport.Options{
+		Compression: t.Compression,
+		Encryption:  t.UseEncryption,
+		Token:       t.SecretKey,
+		ConnID:      protocol.VisitorStreamID(req.Nonce),
+	})
+	if err != nil {
+		log.Printf("Failed to set up visitor stream for %s: %v", t.Name, err)
+		return false
+	}
+
+	log.Printf("Visitor from %s connected to secret tunnel %s", conn.RemoteAddr(), t.Name)
+	go s.handlePublicConnection(t, conn)
+	return true
+}
+
+// useVisitorNonce records the nonce of a visitor request signed at timestamp. It
+// reports false if the nonce was already used while the signature is valid.
+func (s *Server) useVisitorNonce(nonce string, timestamp int64) bool {
+	s.visitorMu.Lock()
+	defer s.visitorMu.Unlock()
+	now := time.Now()
+	for n, expires := range s.visitorNonces {
+		if now.After(expires) {
+			delete(s.visitorNonces, n)
+		}
+	}
+	if _, used := s.visitorNonces[nonce]; used {
+		return false
+	}
+	if s.visitorNonces == nil {
+		s.visitorNonces = make(map[string]time.Time)
+	}
+	s.visitorNonces[nonce] = time.Unix(timestamp, 0).Add(visitorMaxClockSkew)
+	return true
+}
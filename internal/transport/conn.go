@@ -0,0 +1,83 @@
+package transport
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"sync/atomic"
+)
+
+// bufferedConn replays bytes a JSON decoder has already read ahead
+// before continuing with the underlying connection.
+type bufferedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// AfterMessages returns conn positioned right after the last message read by dec.
+// Use it when a connection switches from JSON messages to raw data, since the
+// decoder may already have buffered the first bytes of that data.
+func AfterMessages(conn net.Conn, dec *json.Decoder) net.Conn {
+	rest, _ := io.ReadAll(dec.Buffered())
+	// json.Encoder terminates every message with a newline
+	rest = bytes.TrimPrefix(rest, []byte("\n"))
+	if len(rest) == 0 {
+		return conn
+	}
+	return &bufferedConn{Conn: conn, r: io.MultiReader(bytes.NewReader(rest), conn)}
+}
+
+// AfterReader returns conn positioned right after what br has consumed,
+// replaying bytes br has buffered but not yet returned.
+func AfterReader(conn net.Conn, br *bufio.Reader) net.Conn {
+	if br.Buffered() == 0 {
+		return conn
+	}
+	rest, _ := br.Peek(br.Buffered())
+	return &bufferedConn{Conn: conn, r: io.MultiReader(bytes.NewReader(rest), conn)}
+}
+
+// countingConn adds the bytes it reads and writes to shared counters.
+type countingConn struct {
+	net.Conn
+	in, out *int64
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	atomic.AddInt64(c.in, int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	atomic.AddInt64(c.out, int64(n))
+	return n, err
+}
+
+// CountBytes returns conn with every byte read added to in and every byte written added to out.
+func CountBytes(conn net.Conn, in, out *int64) net.Conn {
+	return &countingConn{Conn: conn, in: in, out: out}
+}
+
+// Join copies data between a and b in both directions. As soon as either side
+// is done, both connections are closed so the other direction does not hang.
+func Join(a, b net.Conn) {
+	done := make(chan struct{}, 2)
+	pipe := func(dst, src net.Conn) {
+		io.Copy(dst, src)
+		done <- struct{}{}
+	}
+	go pipe(a, b)
+	go pipe(b, a)
+	<-done
+	a.Close()
+	b.Close()
+	<-done
+}
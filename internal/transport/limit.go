@@ -0,0 +1,92 @@
+package transport
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// Reads and writes pass a limiter in chunks of at most this size, so slow rates
+// do not stall a connection for a long time on one large buffer.
+const limitChunk = 4 * 1024
+
+// Limiter caps the throughput of the connections sharing it, in bytes per
+// second. The rate can be changed while connections use it, zero means no limit.
+type Limiter struct {
+	mu     sync.Mutex
+	rate   int64
+	tokens float64 // Bytes that may pass now, negative when callers are waiting
+	last   time.Time
+}
+
+func NewLimiter(rate int64) *Limiter {
+	return &Limiter{rate: rate, last: time.Now()}
+}
+
+// SetRate changes the limit for bytes not yet let through.
+func (l *Limiter) SetRate(rate int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill(time.Now())
+	l.rate = rate
+}
+
+func (l *Limiter) refill(now time.Time) {
+	l.tokens += now.Sub(l.last).Seconds() * float64(l.rate)
+	// At most one second of burst
+	if l.tokens > float64(l.rate) {
+		l.tokens = float64(l.rate)
+	}
+	l.last = now
+}
+
+// wait blocks until n bytes may pass.
+func (l *Limiter) wait(n int) {
+	l.mu.Lock()
+	if l.rate <= 0 {
+		l.mu.Unlock()
+		return
+	}
+	l.refill(time.Now())
+	l.tokens -= float64(n)
+	delay := time.Duration(-l.tokens / float64(l.rate) * float64(time.Second))
+	l.mu.Unlock()
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// limitedConn passes what it reads through in and what it writes through out.
+type limitedConn struct {
+	net.Conn
+	in, out *Limiter
+}
+
+func (c *limitedConn) Read(p []byte) (int, error) {
+	if len(p) > limitChunk {
+		p = p[:limitChunk]
+	}
+	n, err := c.Conn.Read(p)
+	c.in.wait(n)
+	return n, err
+}
+
+func (c *limitedConn) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p[:min(len(p), limitChunk)]
+		c.out.wait(len(chunk))
+		n, err := c.Conn.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Limit returns conn with its reads limited by in and its writes limited by out.
+func Limit(conn net.Conn, in, out *Limiter) net.Conn {
+	return &limitedConn{Conn: conn, in: in, out: out}
+}
@@ -0,0 +1,55 @@
+package transport
+
+import (
+	"net"
+	"net/http"
+	"sync"
+)
+
+// ServeHTTP runs an HTTP server on a single tunnel connection and returns once it is closed.
+func ServeHTTP(conn net.Conn, handler http.Handler) {
+	ln := &singleConnListener{done: make(chan struct{})}
+	ln.conn = &notifyCloseConn{Conn: conn, onClose: ln.close}
+	srv := &http.Server{Handler: handler}
+	srv.Serve(ln)
+}
+
+// singleConnListener hands out one connection, then blocks until it is closed.
+type singleConnListener struct {
+	conn     net.Conn
+	accepted bool
+	done     chan struct{}
+	once     sync.Once
+}
+
+func (l *singleConnListener) Accept() (net.Conn, error) {
+	if !l.accepted {
+		l.accepted = true
+		return l.conn, nil
+	}
+	<-l.done
+	return nil, net.ErrClosed
+}
+
+func (l *singleConnListener) close() {
+	l.once.Do(func() { close(l.done) })
+}
+
+func (l *singleConnListener) Close() error {
+	l.close()
+	return nil
+}
+
+func (l *singleConnListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+type notifyCloseConn struct {
+	net.Conn
+	onClose func()
+}
+
+func (c *notifyCloseConn) Close() error {
+	c.onClose()
+	return c.Conn.Close()
+}
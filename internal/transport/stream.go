@@ -0,0 +1,206 @@
+package transport
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	CompressionSnappy = "snappy"
+	CompressionZstd   = "zstd"
+
+	// Maximum plaintext carried by a single encrypted frame
+	maxFrameSize = 16 * 1024
+)
+
+// Options describes how a tunnel data stream is wrapped.
+type Options struct {
+	Compression string // "", "snappy" or "zstd"
+	Encryption  bool
+	Token       string // Shared secret the stream key is derived from
+	ConnID      string // Makes every connection use its own key
+	IsClient    bool   // Selects the read/write key direction
+}
+
+// ValidCompression reports whether name is a supported compression algorithm.
+func ValidCompression(name string) bool {
+	return name == "" || name == CompressionSnappy || name == CompressionZstd
+}
+
+// Wrap layers compression and encryption on top of conn according to opts.
+// Data is compressed first and then encrypted before it hits the wire.
+func Wrap(conn net.Conn, opts Options) (net.Conn, error) {
+	if opts.Compression == "" && !opts.Encryption {
+		return conn, nil
+	}
+	if !ValidCompression(opts.Compression) {
+		return nil, fmt.Errorf("unsupported compression: %s", opts.Compression)
+	}
+
+	sc := &streamConn{Conn: conn, r: conn, w: conn}
+
+	if opts.Encryption {
+		writeDir, readDir := "c2s", "s2c"
+		if !opts.IsClient {
+			writeDir, readDir = readDir, writeDir
+		}
+		wAEAD, err := newAEAD(opts.Token, opts.ConnID, writeDir)
+		if err != nil {
+			return nil, err
+		}
+		rAEAD, err := newAEAD(opts.Token, opts.ConnID, readDir)
+		if err != nil {
+			return nil, err
+		}
+		sc.r = &cryptoReader{r: conn, aead: rAEAD}
+		sc.w = &cryptoWriter{w: conn, aead: wAEAD}
+	}
+
+	switch opts.Compression {
+	case CompressionSnappy:
+		sw := snappy.NewBufferedWriter(sc.w)
+		sc.r = snappy.NewReader(sc.r)
+		sc.w = sw
+		sc.flush = sw.Flush
+		sc.closers = append(sc.closers, sw.Close)
+	case CompressionZstd:
+		zw, err := zstd.NewWriter(sc.w, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		zr, err := zstd.NewReader(sc.r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			zw.Close()
+			return nil, err
+		}
+		sc.r = zr
+		sc.w = zw
+		sc.flush = zw.Flush
+		sc.closers = append(sc.closers, zw.Close, func() error {
+			zr.Close()
+			return nil
+		})
+	}
+
+	return sc, nil
+}
+
+// streamConn is a net.Conn whose reads and writes go through the wrapping layers.
+type streamConn struct {
+	net.Conn
+	r       io.Reader
+	w       io.Writer
+	flush   func() error
+	closers []func() error
+}
+
+func (c *streamConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *streamConn) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	// Flush every write so interactive traffic is not held back by the compressor
+	if c.flush != nil {
+		if err := c.flush(); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func (c *streamConn) Close() error {
+	for _, closeFn := range c.closers {
+		closeFn()
+	}
+	return c.Conn.Close()
+}
+
+func newAEAD(token, connID, direction string) (cipher.AEAD, error) {
+	mac := hmac.New(sha256.New, []byte(token))
+	mac.Write([]byte("openproxy/stream/" + connID + "/" + direction))
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// cryptoWriter seals data into length-prefixed AES-GCM frames.
+type cryptoWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	counter uint64
+}
+
+func (cw *cryptoWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > maxFrameSize {
+			chunk = chunk[:maxFrameSize]
+		}
+
+		nonce := make([]byte, cw.aead.NonceSize())
+		binary.BigEndian.PutUint64(nonce[len(nonce)-8:], cw.counter)
+		cw.counter++
+
+		frame := make([]byte, 2, 2+len(chunk)+cw.aead.Overhead())
+		frame = cw.aead.Seal(frame, nonce, chunk, nil)
+		binary.BigEndian.PutUint16(frame[:2], uint16(len(frame)-2))
+
+		if _, err := cw.w.Write(frame); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
+
+// cryptoReader opens frames produced by cryptoWriter.
+type cryptoReader struct {
+	r       io.Reader
+	aead    cipher.AEAD
+	counter uint64
+	buf     []byte
+}
+
+func (cr *cryptoReader) Read(p []byte) (int, error) {
+	if len(cr.buf) == 0 {
+		var header [2]byte
+		if _, err := io.ReadFull(cr.r, header[:]); err != nil {
+			return 0, err
+		}
+		frame := make([]byte, binary.BigEndian.Uint16(header[:]))
+		if _, err := io.ReadFull(cr.r, frame); err != nil {
+			return 0, err
+		}
+
+		nonce := make([]byte, cr.aead.NonceSize())
+		binary.BigEndian.PutUint64(nonce[len(nonce)-8:], cr.counter)
+		cr.counter++
+
+		plain, err := cr.aead.Open(frame[:0], nonce, frame, nil)
+		if err != nil {
+			return 0, fmt.Errorf("decrypt stream: %w", err)
+		}
+		cr.buf = plain
+	}
+
+	n := copy(p, cr.buf)
+	cr.buf = cr.buf[n:]
+	return n, nil
+}
@@ -0,0 +1,94 @@
+package web
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"openproxy/internal/api"
+	"openproxy/internal/audit"
+)
+
+// audit records an action taken through the web API by the caller of r.
+// err is its outcome, nil when it succeeded.
+func (h *Handler) audit(r *http.Request, action, target string, changes []api.AuditChange, err *apiError) {
+	e := api.AuditEntry{
+		Action:   action,
+		Actor:    identityFrom(r).Username,
+		SourceIP: audit.SourceIP(r.RemoteAddr),
+		Target:   target,
+		Success:  err == nil,
+		Changes:  changes,
+	}
+	if err != nil {
+		e.Message = err.message
+	}
+	// Anyone reaching the dashboard can fail to log in, limited per source
+	if action == api.AuditLogin && err != nil {
+		h.auditLog.RecordLimited(action+":"+e.SourceIP, e)
+		return
+	}
+	h.auditLog.Record(e)
+}
+
+// parseTime reads a query time, either RFC 3339 or a range before now like 24h or 7d.
+func parseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	d, err := parseRange(s)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Now().Add(-d), nil
+}
+
+// v1Audit returns the newest audit entries, filtered by the query parameters
+// action, actor, target, source_ip, success, since, until and limit.
+func (h *Handler) v1Audit(w http.ResponseWriter, r *http.Request) {
+	if h.auditLog == nil {
+		writeError(w, http.StatusNotFound, api.CodeNotFound, "audit log is disabled")
+		return
+	}
+
+	q := r.URL.Query()
+	f := audit.Filter{
+		Action:   q.Get("action"),
+		Actor:    q.Get("actor"),
+		Target:   q.Get("target"),
+		SourceIP: q.Get("source_ip"),
+	}
+	if s := q.Get("success"); s != "" {
+		success, err := strconv.ParseBool(s)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, api.CodeBadRequest, "invalid success "+s)
+			return
+		}
+		f.Success = &success
+	}
+	var err error
+	if f.Since, err = parseTime(q.Get("since")); err != nil {
+		writeError(w, http.StatusBadRequest, api.CodeBadRequest, "invalid since: "+err.Error())
+		return
+	}
+	if f.Until, err = parseTime(q.Get("until")); err != nil {
+		writeError(w, http.StatusBadRequest, api.CodeBadRequest, "invalid until: "+err.Error())
+		return
+	}
+	if s := q.Get("limit"); s != "" {
+		if f.Limit, err = strconv.Atoi(s); err != nil || f.Limit < 1 {
+			writeError(w, http.StatusBadRequest, api.CodeBadRequest, "invalid limit "+s)
+			return
+		}
+	}
+
+	entries, err := h.auditLog.Query(f)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, api.CodeInternal, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, api.AuditLog{Entries: entries})
+}
@@ -0,0 +1,54 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultHistoryRange = 24 * time.Hour
+
+// parseRange parses a Go duration, or a number of days like "30d".
+func parseRange(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("invalid range %q", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid range %q", s)
+	}
+	return d, nil
+}
+
+// handleHistory returns the stored traffic of the last ?range (default 24h), for
+// every tunnel or only ?tunnel. ?step picks the resolution, 1m, 1h or 1d.
+func (h *Handler) handleHistory(w http.ResponseWriter, r *http.Request) {
+	if h.history == nil {
+		http.Error(w, "traffic history is disabled", http.StatusNotFound)
+		return
+	}
+
+	span := defaultHistoryRange
+	if s := r.URL.Query().Get("range"); s != "" {
+		d, err := parseRange(s)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		span = d
+	}
+	to := time.Now()
+	history, err := h.history.Query(to.Add(-span), to, r.URL.Query().Get("step"), r.URL.Query().Get("tunnel"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	json.NewEncoder(w).Encode(history)
+}
@@ -0,0 +1,159 @@
+package web
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"openproxy/internal/config"
+)
+
+const (
+	sessionCookie     = "openproxy_session"
+	defaultSessionTTL = 12 * time.Hour
+)
+
+// session is the signed content of a session cookie.
+type session struct {
+	ID       string `json:"id"`
+	Username string `json:"u"`
+	Expires  int64  `json:"exp"` // Unix seconds
+}
+
+// sessionManager issues and checks signed session cookies. Cookies carry the
+// session themselves, only sessions ended by a logout are remembered until they expire.
+type sessionManager struct {
+	secret  []byte
+	ttl     time.Duration
+	revoked map[string]int64 // Session ID to expiry
+	mu      sync.Mutex
+}
+
+func newSessionManager(cfg config.WebConfig) *sessionManager {
+	secret := []byte(cfg.SessionSecret)
+	if len(secret) == 0 {
+		// Without a configured secret, logins do not survive a restart
+		secret = make([]byte, 32)
+		rand.Read(secret)
+	}
+	ttl := defaultSessionTTL
+	if cfg.SessionTTL > 0 {
+		ttl = time.Duration(cfg.SessionTTL) * time.Second
+	}
+	return &sessionManager{secret: secret, ttl: ttl, revoked: make(map[string]int64)}
+}
+
+func (m *sessionManager) sign(payload string) string {
+	mac := hmac.New(sha256.New, m.secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// issue sets a session cookie for username.
+func (m *sessionManager) issue(w http.ResponseWriter, r *http.Request, username string) {
+	id := make([]byte, 16)
+	rand.Read(id)
+	sess := session{ID: hex.EncodeToString(id), Username: username, Expires: time.Now().Add(m.ttl).Unix()}
+	data, _ := json.Marshal(sess)
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    payload + "." + m.sign(payload),
+		Path:     "/",
+		Expires:  time.Unix(sess.Expires, 0),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// check returns the valid, unexpired session in the request's cookie.
+func (m *sessionManager) check(r *http.Request) (*session, error) {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return nil, err
+	}
+	payload, sig, ok := strings.Cut(cookie.Value, ".")
+	if !ok || !hmac.Equal([]byte(sig), []byte(m.sign(payload))) {
+		return nil, errors.New("invalid session signature")
+	}
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, err
+	}
+	var sess session
+	if err := json.Unmarshal(data, &sess); err != nil {
+		return nil, err
+	}
+	if time.Now().Unix() >= sess.Expires {
+		return nil, errors.New("session expired")
+	}
+
+	m.mu.Lock()
+	_, revoked := m.revoked[sess.ID]
+	m.mu.Unlock()
+	if revoked {
+		return nil, errors.New("session logged out")
+	}
+	return &sess, nil
+}
+
+// revoke ends sess and clears its cookie.
+func (m *sessionManager) revoke(w http.ResponseWriter, sess *session) {
+	now := time.Now().Unix()
+	m.mu.Lock()
+	for id, exp := range m.revoked {
+		if exp <= now {
+			delete(m.revoked, id)
+		}
+	}
+	m.revoked[sess.ID] = sess.Expires
+	m.mu.Unlock()
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// identity is who a request acts as. Requests made with an API token are
+// limited to the scopes of the token.
+type identity struct {
+	config.WebUser
+	Token *config.APIToken
+}
+
+// allows reports whether the identity may use endpoints needing scope. Endpoints
+// without a scope are only open to dashboard logins.
+func (id identity) allows(scope string) bool {
+	if id.Token == nil {
+		return true
+	}
+	return scope != "" && id.Token.HasScope(scope)
+}
+
+type identityContextKey struct{}
+
+// withIdentity returns r carrying the authenticated identity for the handlers.
+func withIdentity(r *http.Request, id identity) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), identityContextKey{}, id))
+}
+
+// identityFrom returns the identity authenticated for r.
+func identityFrom(r *http.Request) identity {
+	id, _ := r.Context().Value(identityContextKey{}).(identity)
+	return id
+}
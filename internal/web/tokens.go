@@ -0,0 +1,215 @@
+package web
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"openproxy/internal/api"
+	"openproxy/internal/audit"
+	"openproxy/internal/config"
+)
+
+// API tokens look like opk_<id>_<secret>. The id finds the stored token,
+// the whole token is checked against its hash.
+const tokenPrefix = "opk_"
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// newToken returns a random token and its id.
+func newToken() (string, string) {
+	id := make([]byte, 6)
+	rand.Read(id)
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	tokenID := hex.EncodeToString(id)
+	return tokenPrefix + tokenID + "_" + base64.RawURLEncoding.EncodeToString(secret), tokenID
+}
+
+// bearerAuth accepts API tokens sent as "Authorization: Bearer <token>".
+func (h *Handler) bearerAuth(r *http.Request) (identity, error) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return identity{}, errNoCredentials
+	}
+	rest, ok := strings.CutPrefix(token, tokenPrefix)
+	tokenID, _, ok2 := strings.Cut(rest, "_")
+	if !ok || !ok2 {
+		return identity{}, errors.New("malformed API token")
+	}
+
+	var found *config.APIToken
+	h.configMu.Lock()
+	for _, t := range h.Config.Web.APITokens {
+		if t.ID == tokenID {
+			t := t
+			found = &t
+			break
+		}
+	}
+	h.configMu.Unlock()
+	if found == nil || subtle.ConstantTimeCompare([]byte(hashToken(token)), []byte(found.Hash)) != 1 {
+		return identity{}, errors.New("invalid API token")
+	}
+	if found.Expired() {
+		return identity{}, errors.New("API token expired")
+	}
+
+	if found.User == "" {
+		return identity{WebUser: config.WebUser{Username: "token:" + found.Name, Role: found.Role}, Token: found}, nil
+	}
+	// Personal tokens follow their user, they stop working when the user is removed
+	user, ok := h.findUser(found.User)
+	if !ok {
+		return identity{}, errors.New("owner of API token no longer exists")
+	}
+	return identity{WebUser: user, Token: found}, nil
+}
+
+// canManageToken reports whether id may see and revoke t.
+func canManageToken(id identity, t config.APIToken) bool {
+	return hasRole(id.WebUser, config.RoleAdmin) || t.User == id.Username || t.CreatedBy == id.Username
+}
+
+// handleTokens lists, creates and revokes API tokens. Admins manage every token,
+// other users their own ones.
+func (h *Handler) handleTokens(w http.ResponseWriter, r *http.Request) {
+	id := identityFrom(r)
+
+	switch r.Method {
+	case http.MethodGet:
+		h.configMu.Lock()
+		tokens := []config.APIToken{}
+		for _, t := range h.Config.Web.APITokens {
+			if canManageToken(id, t) {
+				t.Hash = ""
+				tokens = append(tokens, t)
+			}
+		}
+		h.configMu.Unlock()
+		json.NewEncoder(w).Encode(tokens)
+
+	case http.MethodPost:
+		var req struct {
+			Name          string   `json:"name"`
+			Scopes        []string `json:"scopes"`
+			ExpiresInDays int      `json:"expires_in_days"` // Never expires if 0
+			Service       bool     `json:"service"`
+			Role          string   `json:"role"` // For service tokens
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Name == "" {
+			http.Error(w, "name is required", http.StatusBadRequest)
+			return
+		}
+		if len(req.Scopes) == 0 {
+			http.Error(w, "at least one scope is required", http.StatusBadRequest)
+			return
+		}
+		for _, s := range req.Scopes {
+			if !validScope(s) {
+				http.Error(w, "unknown scope "+s, http.StatusBadRequest)
+				return
+			}
+		}
+
+		token, tokenID := newToken()
+		t := config.APIToken{
+			ID:        tokenID,
+			Name:      req.Name,
+			Hash:      hashToken(token),
+			Scopes:    req.Scopes,
+			CreatedBy: id.Username,
+			CreatedAt: time.Now().UTC().Truncate(time.Second),
+		}
+		if req.ExpiresInDays > 0 {
+			expires := t.CreatedAt.AddDate(0, 0, req.ExpiresInDays)
+			t.ExpiresAt = &expires
+		}
+		if req.Service {
+			if !hasRole(id.WebUser, config.RoleAdmin) {
+				http.Error(w, "only admins can create service tokens", http.StatusForbidden)
+				return
+			}
+			if _, ok := roleRank[req.Role]; !ok {
+				http.Error(w, "invalid role "+req.Role, http.StatusBadRequest)
+				return
+			}
+			t.Role = req.Role
+		} else {
+			t.User = id.Username
+		}
+
+		h.configMu.Lock()
+		h.Config.Web.APITokens = append(h.Config.Web.APITokens, t)
+		err := config.SaveConfig(h.ConfigPath, h.Config)
+		if err != nil {
+			h.Config.Web.APITokens = h.Config.Web.APITokens[:len(h.Config.Web.APITokens)-1]
+		}
+		h.configMu.Unlock()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Printf("API token %s (%s) created by %s", t.Name, t.ID, id.Username)
+		created := t
+		created.Hash = ""
+		h.audit(r, api.AuditTokenCreate, t.Name, audit.Diff(nil, created, nil, created), nil)
+
+		// The token itself is only ever shown in this response
+		t.Hash = ""
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(struct {
+			config.APIToken
+			Token string `json:"token"`
+		}{t, token})
+
+	case http.MethodDelete:
+		tokenID := r.URL.Query().Get("id")
+		h.configMu.Lock()
+		defer h.configMu.Unlock()
+		for i, t := range h.Config.Web.APITokens {
+			if t.ID != tokenID {
+				continue
+			}
+			if !canManageToken(id, t) {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			tokens := append([]config.APIToken{}, h.Config.Web.APITokens[:i]...)
+			h.Config.Web.APITokens = append(tokens, h.Config.Web.APITokens[i+1:]...)
+			if err := config.SaveConfig(h.ConfigPath, h.Config); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			log.Printf("API token %s (%s) revoked by %s", t.Name, t.ID, id.Username)
+			h.audit(r, api.AuditTokenRevoke, t.Name, nil, nil)
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		http.Error(w, "token not found", http.StatusNotFound)
+	}
+}
+
+func validScope(scope string) bool {
+	for _, s := range config.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
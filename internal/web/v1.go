@@ -0,0 +1,242 @@
+package web
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+
+	"openproxy/internal/api"
+	"openproxy/internal/config"
+	"openproxy/internal/conntrack"
+)
+
+//go:embed openapi.json
+var openAPISpec []byte
+
+const openAPIPath = "/api/v1/openapi.json"
+
+// registerV1 adds the versioned REST API. Unlike the endpoints the dashboard
+// grew up with, every v1 response is JSON, errors included.
+func (h *Handler) registerV1(mux *http.ServeMux) {
+	mux.HandleFunc(openAPIPath, h.handleOpenAPI)
+	mux.HandleFunc("/api/v1/tunnels", h.authorize(access{
+		http.MethodGet:  {config.RoleViewer, config.ScopeStatusRead},
+		http.MethodPost: {config.RoleOperator, config.ScopeTunnelsWrite},
+	}, h.v1Tunnels))
+	mux.HandleFunc("/api/v1/tunnels/{name}", h.authorize(access{
+		http.MethodGet:    {config.RoleViewer, config.ScopeStatusRead},
+		http.MethodPut:    {config.RoleOperator, config.ScopeTunnelsWrite},
+		http.MethodPatch:  {config.RoleOperator, config.ScopeTunnelsWrite},
+		http.MethodDelete: {config.RoleOperator, config.ScopeTunnelsWrite},
+	}, h.v1Tunnel))
+	mux.HandleFunc("/api/v1/sessions", h.authorize(access{http.MethodGet: {config.RoleViewer, config.ScopeStatusRead}}, h.v1Sessions))
+	mux.HandleFunc("/api/v1/connections", h.authorize(access{http.MethodGet: {config.RoleViewer, config.ScopeStatusRead}}, h.v1Connections))
+	mux.HandleFunc("/api/v1/connections/{id}", h.authorize(access{http.MethodDelete: {config.RoleOperator, config.ScopeTunnelsWrite}}, h.v1Connection))
+	mux.HandleFunc("/api/v1/config", h.authorize(access{
+		http.MethodGet: {config.RoleViewer, config.ScopeConfigRead},
+		http.MethodPut: {config.RoleAdmin, config.ScopeConfigWrite},
+	}, h.v1Config))
+	mux.HandleFunc("/api/v1/config/versions", h.authorize(access{http.MethodGet: {config.RoleAdmin, config.ScopeConfigRead}}, h.v1ConfigVersions))
+	mux.HandleFunc("/api/v1/config/versions/{version}", h.authorize(access{http.MethodGet: {config.RoleAdmin, config.ScopeConfigRead}}, h.v1ConfigVersion))
+	mux.HandleFunc("/api/v1/config/versions/{version}/rollback", h.authorize(access{http.MethodPost: {config.RoleAdmin, config.ScopeConfigWrite}}, h.v1ConfigRollback))
+	mux.HandleFunc("/api/v1/audit", h.authorize(access{http.MethodGet: {config.RoleAdmin, config.ScopeAuditRead}}, h.v1Audit))
+	mux.HandleFunc("/api/v1/", func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, http.StatusNotFound, api.CodeNotFound, "no such endpoint "+r.URL.Path)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	writeJSON(w, status, api.ErrorResponse{Error: api.Error{Code: code, Message: message}})
+}
+
+func writeAPIError(w http.ResponseWriter, err *apiError) {
+	writeError(w, err.status(), err.code, err.message)
+}
+
+// fail reports an error in the format of the API the request was made to.
+func fail(w http.ResponseWriter, r *http.Request, status int, code, message string) {
+	if strings.HasPrefix(r.URL.Path, "/api/v1/") {
+		writeError(w, status, code, message)
+		return
+	}
+	http.Error(w, message, status)
+}
+
+// decodeBody decodes a JSON request body into v, rejecting unknown fields.
+func decodeBody(r *http.Request, v interface{}) *apiError {
+	return decodeJSON(r.Body, v)
+}
+
+// decodeJSON decodes a request body already read, rejecting unknown fields like decodeBody.
+func decodeJSON(body io.Reader, v interface{}) *apiError {
+	dec := json.NewDecoder(body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return newAPIError(api.CodeBadRequest, "invalid request body: %v", err)
+	}
+	return nil
+}
+
+func (h *Handler) handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPISpec)
+}
+
+// findTunnel returns the named tunnel as the provider reports it.
+func (h *Handler) findTunnel(name string) (api.Tunnel, bool) {
+	for _, t := range h.Provider.Tunnels() {
+		if t.Name == name {
+			return t, true
+		}
+	}
+	return api.Tunnel{}, false
+}
+
+func (h *Handler) v1Tunnels(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		var t config.Tunnel
+		if err := decodeBody(r, &t); err != nil {
+			writeAPIError(w, err)
+			return
+		}
+		if err := h.addTunnel(r, t); err != nil {
+			writeAPIError(w, err)
+			return
+		}
+		created, _ := h.findTunnel(t.Name)
+		writeJSON(w, http.StatusCreated, created)
+		return
+	}
+
+	tunnels := h.Provider.Tunnels()
+	sort.Slice(tunnels, func(i, j int) bool { return tunnels[i].Name < tunnels[j].Name })
+	writeJSON(w, http.StatusOK, api.TunnelList{Tunnels: tunnels})
+}
+
+// v1Tunnel reads, replaces, partially updates or deletes one tunnel. PUT takes a
+// whole tunnel, PATCH only the fields to change.
+func (h *Handler) v1Tunnel(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+
+	switch r.Method {
+	case http.MethodGet:
+		t, ok := h.findTunnel(name)
+		if !ok {
+			writeError(w, http.StatusNotFound, api.CodeNotFound, "tunnel "+name+" not found")
+			return
+		}
+		writeJSON(w, http.StatusOK, t)
+
+	case http.MethodPut, http.MethodPatch:
+		// Read before taking the config lock, a slow client must not hold it
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, api.CodeBadRequest, "invalid request body: "+err.Error())
+			return
+		}
+		merge := func(current config.Tunnel) (config.Tunnel, *apiError) {
+			var t config.Tunnel
+			if r.Method == http.MethodPatch {
+				// Fields missing from the body keep their current value. The patch is
+				// decoded over a deep copy, json reuses the maps and slices it finds
+				// and would change the live tunnel in place.
+				data, _ := json.Marshal(current)
+				json.Unmarshal(data, &t)
+			}
+			if err := decodeJSON(bytes.NewReader(body), &t); err != nil {
+				return t, err
+			}
+			if t.Name == "" {
+				t.Name = name
+			}
+			return t, nil
+		}
+		if err := h.updateTunnel(r, name, merge); err != nil {
+			writeAPIError(w, err)
+			return
+		}
+		updated, _ := h.findTunnel(name)
+		writeJSON(w, http.StatusOK, updated)
+
+	case http.MethodDelete:
+		if err := h.removeTunnel(r, name); err != nil {
+			writeAPIError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (h *Handler) v1Sessions(w http.ResponseWriter, r *http.Request) {
+	sessions := h.Provider.Sessions()
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].StartTime.Before(sessions[j].StartTime) })
+	writeJSON(w, http.StatusOK, api.SessionList{Sessions: sessions})
+}
+
+func (h *Handler) v1Connections(w http.ResponseWriter, r *http.Request) {
+	conns := h.Provider.Connections()
+	sort.Slice(conns, func(i, j int) bool { return conns[i].StartTime.Before(conns[j].StartTime) })
+	writeJSON(w, http.StatusOK, api.ConnectionList{Connections: conns})
+}
+
+// v1Connection kills a connection.
+func (h *Handler) v1Connection(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if err := h.Provider.KillConnection(id); err != nil {
+		if errors.Is(err, conntrack.ErrNotFound) {
+			writeError(w, http.StatusNotFound, api.CodeNotFound, "connection "+id+" not found")
+			return
+		}
+		h.audit(r, api.AuditConnKill, id, nil, newAPIError(api.CodeInternal, "%v", err))
+		writeError(w, http.StatusInternalServerError, api.CodeInternal, err.Error())
+		return
+	}
+	log.Printf("Connection %s killed by %s", id, identityFrom(r).Username)
+	h.audit(r, api.AuditConnKill, id, nil, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) v1Config(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPut {
+		if err := requireIfMatch(r); err != nil {
+			writeAPIError(w, err)
+			return
+		}
+		var cfg config.Config
+		if err := decodeBody(r, &cfg); err != nil {
+			writeAPIError(w, err)
+			return
+		}
+		if err := cfg.Validate(); err != nil {
+			writeError(w, http.StatusBadRequest, api.CodeBadRequest, err.Error())
+			return
+		}
+		etag, err := h.saveConfig(r, api.AuditConfigSave, h.ConfigPath, cfg)
+		if err != nil {
+			writeAPIError(w, err)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		writeJSON(w, http.StatusOK, api.ConfigSaved{
+			Message:         "Configuration saved. Please restart the application to apply changes.",
+			RestartRequired: true,
+		})
+		return
+	}
+
+	cfg, etag := h.currentConfig(r)
+	w.Header().Set("ETag", etag)
+	writeJSON(w, http.StatusOK, cfg)
+}
@@ -0,0 +1,146 @@
+package web
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"openproxy/internal/api"
+	"openproxy/internal/audit"
+	"openproxy/internal/config"
+)
+
+// configETag identifies the content of cfg, for If-Match on saves.
+func configETag(cfg *config.Config) string {
+	data, _ := json.Marshal(cfg)
+	sum := sha256.Sum256(data)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// ifMatch reports whether the If-Match header of r allows changing the
+// resource with etag. Callers make sure it is sent with requireIfMatch.
+func ifMatch(r *http.Request, etag string) bool {
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		return true
+	}
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// requireIfMatch fails requests without an If-Match header, for saves of the
+// whole config and rollbacks, which would silently undo changes made meanwhile.
+func requireIfMatch(r *http.Request) *apiError {
+	if r.Header.Get("If-Match") == "" {
+		return newAPIError(api.CodePreconditionReq, "If-Match is required, reload the config and send its ETag")
+	}
+	return nil
+}
+
+// currentConfig returns the config as the caller of r may see it, and its ETag.
+func (h *Handler) currentConfig(r *http.Request) (config.Config, string) {
+	h.configMu.Lock()
+	defer h.configMu.Unlock()
+	cfg := *h.Config
+	// Only admins see tokens and passwords
+	if !hasRole(identityFrom(r).WebUser, config.RoleAdmin) {
+		cfg = cfg.Redacted()
+	}
+	return cfg, configETag(h.Config)
+}
+
+// loadVersion reads the version of the config file named in the request path.
+// Its accounts and API tokens are replaced by the current ones, so comparing
+// with it leaves them out and rolling back to it does not bring back removed
+// users or revoked tokens.
+func (h *Handler) loadVersion(r *http.Request) (config.Version, *config.Config, *apiError) {
+	n, err := strconv.Atoi(r.PathValue("version"))
+	if err != nil {
+		return config.Version{}, nil, newAPIError(api.CodeBadRequest, "invalid version %s", r.PathValue("version"))
+	}
+	cfg, err := config.LoadVersion(h.ConfigPath, n)
+	if errors.Is(err, config.ErrVersionNotFound) {
+		return config.Version{}, nil, newAPIError(api.CodeNotFound, "config version %d not found", n)
+	}
+	if err != nil {
+		return config.Version{}, nil, newAPIError(api.CodeInternal, "config version %d: %v", n, err)
+	}
+	h.configMu.Lock()
+	cfg.Web.Username, cfg.Web.Password = h.Config.Web.Username, h.Config.Web.Password
+	cfg.Web.Users, cfg.Web.APITokens = h.Config.Web.Users, h.Config.Web.APITokens
+	h.configMu.Unlock()
+	versions, err := config.ListVersions(h.ConfigPath)
+	if err != nil {
+		return config.Version{}, nil, newAPIError(api.CodeInternal, "%v", err)
+	}
+	for _, v := range versions {
+		if v.Number == n {
+			return v, cfg, nil
+		}
+	}
+	// Pruned while it was being read
+	return config.Version{}, nil, newAPIError(api.CodeNotFound, "config version %d not found", n)
+}
+
+func (h *Handler) v1ConfigVersions(w http.ResponseWriter, r *http.Request) {
+	versions, err := config.ListVersions(h.ConfigPath)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, api.CodeInternal, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, api.ConfigVersionList{Versions: versions})
+}
+
+// v1ConfigVersion returns what changed between a version and the current config.
+func (h *Handler) v1ConfigVersion(w http.ResponseWriter, r *http.Request) {
+	version, cfg, apiErr := h.loadVersion(r)
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+	current, etag := h.currentConfig(r)
+	changes := audit.Diff(cfg, current, cfg.Redacted(), current.Redacted())
+	if changes == nil {
+		changes = []api.AuditChange{}
+	}
+	w.Header().Set("ETag", etag)
+	writeJSON(w, http.StatusOK, api.ConfigVersion{Version: version, Changes: changes})
+}
+
+// v1ConfigRollback makes a version the current config again. The config it
+// replaces is kept as a new version, so a rollback can be undone.
+func (h *Handler) v1ConfigRollback(w http.ResponseWriter, r *http.Request) {
+	if apiErr := requireIfMatch(r); apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+	version, cfg, apiErr := h.loadVersion(r)
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+	if err := cfg.Validate(); err != nil {
+		writeError(w, http.StatusBadRequest, api.CodeBadRequest, "config version is invalid: "+err.Error())
+		return
+	}
+	etag, apiErr := h.saveConfig(r, api.AuditConfigRollback, fmt.Sprintf("%s version %d", h.ConfigPath, version.Number), *cfg)
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+	w.Header().Set("ETag", etag)
+	writeJSON(w, http.StatusOK, api.ConfigSaved{
+		Message:         fmt.Sprintf("Configuration rolled back to version %d. Please restart the application to apply changes.", version.Number),
+		RestartRequired: true,
+	})
+}
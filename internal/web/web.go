@@ -1,15 +1,26 @@
 package web
 
 import (
-	"crypto/subtle"
 	"embed"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/fs"
 	"log"
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/gorilla/websocket"
+
+	"openproxy/internal/api"
+	"openproxy/internal/audit"
 	"openproxy/internal/config"
+	"openproxy/internal/events"
+	"openproxy/internal/metrics"
 )
 
 //go:embed static/*
@@ -18,20 +29,60 @@ var staticFiles embed.FS
 type StatusProvider interface {
 	GetStatus() interface{}
 	AddTunnel(t config.Tunnel) error
+	UpdateTunnel(t config.Tunnel) error
 	RemoveTunnel(name string) error
+	GetInspections(tunnel string) (interface{}, error)
+	ReplayRequest(id uint64) (interface{}, error)
+	Events() *events.Bus
+	Tunnels() []api.Tunnel
+	Sessions() []api.Session
+	Connections() []api.Connection
+	KillConnection(id string) error
 }
 
 type Handler struct {
 	Config     *config.Config
 	ConfigPath string
 	Provider   StatusProvider
+	sessions   *sessionManager
+	authChain  []authenticator
+	configMu   sync.Mutex // Serializes changes to Config made through the API, held to read the accounts
+	history    *metrics.Store
+	auditLog   *audit.Log
 }
 
-func Start(cfg *config.Config, configPath string, provider StatusProvider) error {
+// Checked against unknown usernames so a failed login takes as long as for a known one
+const dummyPasswordHash = "$2a$10$qcI50.T/3JhBF8gs0VIECO3Vyqw28Vbl48AP/NLqyi4x0QxUWcPzO"
+
+// Start serves the dashboard and its API. Actions taken through it are recorded
+// to auditLog, which may be nil.
+func Start(cfg *config.Config, configPath string, provider StatusProvider, auditLog *audit.Log) error {
 	h := &Handler{
 		Config:     cfg,
 		ConfigPath: configPath,
 		Provider:   provider,
+		sessions:   newSessionManager(cfg.Web),
+		auditLog:   auditLog,
+	}
+	h.authChain = []authenticator{h.bearerAuth, h.sessionAuth, h.basicAuth}
+
+	for _, u := range cfg.Web.Users {
+		if !IsPasswordHash(u.PasswordHash) {
+			return fmt.Errorf("web user %s: password_hash is not a bcrypt or argon2id hash, generate one with \"openproxy hash-password\"", u.Username)
+		}
+	}
+	if len(cfg.Web.Users) == 0 && cfg.Web.Password != "" && !IsPasswordHash(cfg.Web.Password) {
+		log.Printf("Web password is stored in plain text, replace it with the output of \"openproxy hash-password\"")
+	}
+
+	if !cfg.Web.History.Disabled {
+		store, err := metrics.Open(cfg.Web.History)
+		if err != nil {
+			log.Printf("Traffic history disabled: %v", err)
+		} else {
+			h.history = store
+			go store.Record(provider.Events())
+		}
 	}
 
 	// Setup FS for static files
@@ -43,38 +94,294 @@ func Start(cfg *config.Config, configPath string, provider StatusProvider) error
 	mux := http.NewServeMux()
 	
 	// API Endpoints
-	mux.HandleFunc("/api/config", h.handleConfig)
-	mux.HandleFunc("/api/status", h.handleStatus)
-	mux.HandleFunc("/api/tunnels", h.handleTunnels)
+	mux.HandleFunc("/api/login", h.handleLogin)
+	mux.HandleFunc("/api/logout", h.handleLogout)
+	mux.HandleFunc("/api/me", h.handleMe)
+	mux.HandleFunc("/api/config", h.authorize(access{
+		http.MethodGet:  {config.RoleViewer, config.ScopeConfigRead},
+		http.MethodPost: {config.RoleAdmin, config.ScopeConfigWrite},
+	}, h.handleConfig))
+	mux.HandleFunc("/api/status", h.authorize(access{http.MethodGet: {config.RoleViewer, config.ScopeStatusRead}}, h.handleStatus))
+	mux.HandleFunc("/api/events", h.authorize(access{http.MethodGet: {config.RoleViewer, config.ScopeStatusRead}}, h.handleEvents))
+	mux.HandleFunc("/api/metrics/history", h.authorize(access{http.MethodGet: {config.RoleViewer, config.ScopeStatusRead}}, h.handleHistory))
+	mux.HandleFunc("/api/tunnels", h.authorize(access{
+		http.MethodPost:   {config.RoleOperator, config.ScopeTunnelsWrite},
+		http.MethodPut:    {config.RoleOperator, config.ScopeTunnelsWrite},
+		http.MethodDelete: {config.RoleOperator, config.ScopeTunnelsWrite},
+	}, h.handleTunnels))
+	mux.HandleFunc("/api/inspect", h.authorize(access{http.MethodGet: {config.RoleOperator, config.ScopeInspect}}, h.handleInspect))
+	mux.HandleFunc("/api/inspect/replay", h.authorize(access{http.MethodPost: {config.RoleOperator, config.ScopeInspect}}, h.handleReplay))
+	// Tokens are managed from the dashboard only, no scope lets a token manage tokens
+	mux.HandleFunc("/api/tokens", h.authorize(access{
+		http.MethodGet:    {config.RoleViewer, ""},
+		http.MethodPost:   {config.RoleViewer, ""},
+		http.MethodDelete: {config.RoleViewer, ""},
+	}, h.handleTokens))
+	h.registerV1(mux)
 	
 	// Static Files
 	mux.Handle("/", http.FileServer(http.FS(staticFS)))
 
 	// Middleware for Auth
-	handler := h.basicAuth(mux)
+	handler := h.requireAuth(mux)
 
 	addr := fmt.Sprintf(":%d", cfg.Web.Port)
 	log.Printf("Web UI listening on %s", addr)
 	return http.ListenAndServe(addr, handler)
 }
 
-func (h *Handler) basicAuth(next http.Handler) http.Handler {
+// users returns the dashboard accounts, falling back to the single admin of older
+// configs. Called with configMu held, saves replace the config.
+func (h *Handler) users() []config.WebUser {
+	if len(h.Config.Web.Users) > 0 {
+		return h.Config.Web.Users
+	}
+	if h.Config.Web.Username == "" {
+		return nil
+	}
+	return []config.WebUser{{Username: h.Config.Web.Username, PasswordHash: h.Config.Web.Password, Role: config.RoleAdmin}}
+}
+
+func (h *Handler) findUser(username string) (config.WebUser, bool) {
+	h.configMu.Lock()
+	defer h.configMu.Unlock()
+	for _, u := range h.users() {
+		if u.Username == username {
+			return u, true
+		}
+	}
+	return config.WebUser{}, false
+}
+
+// checkCredentials returns the user matching username and password.
+func (h *Handler) checkCredentials(username, password string) (config.WebUser, bool) {
+	user, ok := h.findUser(username)
+	if !ok {
+		checkPassword(dummyPasswordHash, password)
+		return config.WebUser{}, false
+	}
+	return user, checkPassword(user.PasswordHash, password)
+}
+
+// errNoCredentials is returned by an authenticator when the request carries
+// none of the credentials it checks, so the next one in the chain is tried.
+var errNoCredentials = errors.New("no credentials")
+
+// authenticator identifies the caller of a request from one kind of credentials.
+type authenticator func(r *http.Request) (identity, error)
+
+// requireAuth lets API requests through once an authenticator of the chain accepts
+// them. The login page and its assets are public.
+func (h *Handler) requireAuth(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		user, pass, ok := r.BasicAuth()
-		if !ok || subtle.ConstantTimeCompare([]byte(user), []byte(h.Config.Web.Username)) != 1 || subtle.ConstantTimeCompare([]byte(pass), []byte(h.Config.Web.Password)) != 1 {
-			w.Header().Set("WWW-Authenticate", `Basic realm="Restricted"`)
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		if !strings.HasPrefix(r.URL.Path, "/api/") || r.URL.Path == "/api/login" || r.URL.Path == openAPIPath {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		for _, auth := range h.authChain {
+			id, err := auth(r)
+			if err == errNoCredentials {
+				continue
+			}
+			if err != nil {
+				// Credentials were given but are wrong, do not fall back to other ones
+				fail(w, r, http.StatusUnauthorized, api.CodeUnauthorized, "Unauthorized: "+err.Error())
+				return
+			}
+			next.ServeHTTP(w, withIdentity(r, id))
 			return
 		}
-		next.ServeHTTP(w, r)
+		fail(w, r, http.StatusUnauthorized, api.CodeUnauthorized, "Unauthorized")
 	})
 }
 
+// sessionAuth accepts the session cookie set by the login endpoint.
+func (h *Handler) sessionAuth(r *http.Request) (identity, error) {
+	if _, err := r.Cookie(sessionCookie); err != nil {
+		return identity{}, errNoCredentials
+	}
+	sess, err := h.sessions.check(r)
+	if err != nil {
+		return identity{}, err
+	}
+	// Look the user up again so removed users and role changes apply at once
+	user, ok := h.findUser(sess.Username)
+	if !ok {
+		return identity{}, errors.New("unknown user")
+	}
+	return identity{WebUser: user}, nil
+}
+
+// basicAuth accepts dashboard credentials sent with HTTP basic auth.
+func (h *Handler) basicAuth(r *http.Request) (identity, error) {
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return identity{}, errNoCredentials
+	}
+	user, ok := h.checkCredentials(username, password)
+	if !ok {
+		return identity{}, errors.New("invalid username or password")
+	}
+	return identity{WebUser: user}, nil
+}
+
+// roleRank orders roles by privilege, each role may do everything the lower ones can
+var roleRank = map[string]int{
+	config.RoleViewer:   1,
+	config.RoleOperator: 2,
+	config.RoleAdmin:    3,
+}
+
+func hasRole(user config.WebUser, role string) bool {
+	return roleRank[user.Role] >= roleRank[role]
+}
+
+// rule is what a caller needs for one method of an endpoint.
+type rule struct {
+	role  string // Least privileged role allowed
+	scope string // Scope API tokens need, none lets only dashboard logins in
+}
+
+// access maps the HTTP methods an endpoint accepts to their rules.
+type access map[string]rule
+
+// authorize rejects methods missing from acl, callers whose role is below the
+// one acl requires and API tokens without the required scope.
+func (h *Handler) authorize(acl access, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rule, ok := acl[r.Method]
+		if !ok {
+			methods := make([]string, 0, len(acl))
+			for m := range acl {
+				methods = append(methods, m)
+			}
+			sort.Strings(methods)
+			w.Header().Set("Allow", strings.Join(methods, ", "))
+			fail(w, r, http.StatusMethodNotAllowed, api.CodeMethodNotAllowed, "Method not allowed")
+			return
+		}
+		id := identityFrom(r)
+		if !hasRole(id.WebUser, rule.role) || !id.allows(rule.scope) {
+			log.Printf("Web user %s (%s) denied %s %s", id.Username, id.Role, r.Method, r.URL.Path)
+			fail(w, r, http.StatusForbidden, api.CodeForbidden, "Forbidden")
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (h *Handler) handleLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	user, ok := h.checkCredentials(req.Username, req.Password)
+	// Nobody is signed in yet, the login is recorded for the name it was attempted with
+	r = withIdentity(r, identity{WebUser: config.WebUser{Username: req.Username}})
+	if !ok {
+		log.Printf("Web login failed for %s from %s", req.Username, r.RemoteAddr)
+		h.audit(r, api.AuditLogin, "", nil, newAPIError(api.CodeUnauthorized, "invalid username or password"))
+		http.Error(w, "Invalid username or password", http.StatusUnauthorized)
+		return
+	}
+	h.sessions.issue(w, r, user.Username)
+	log.Printf("Web login of %s (%s) from %s", user.Username, user.Role, r.RemoteAddr)
+	h.audit(r, api.AuditLogin, "", nil, nil)
+	json.NewEncoder(w).Encode(map[string]string{"username": user.Username, "role": user.Role})
+}
+
+func (h *Handler) handleLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if sess, err := h.sessions.check(r); err == nil {
+		h.sessions.revoke(w, sess)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *Handler) handleMe(w http.ResponseWriter, r *http.Request) {
+	id := identityFrom(r)
+	json.NewEncoder(w).Encode(map[string]string{"username": id.Username, "role": id.Role})
+}
+
 func (h *Handler) handleStatus(w http.ResponseWriter, r *http.Request) {
 	status := h.Provider.GetStatus()
 	json.NewEncoder(w).Encode(status)
 }
 
+const (
+	eventsWriteTimeout = 10 * time.Second
+	eventsPingInterval = 30 * time.Second
+)
+
+// The default origin check only lets the dashboard itself open the socket
+var upgrader = websocket.Upgrader{}
+
+// handleEvents pushes live status changes over a WebSocket. The first message
+// carries the full status, every later one a single event.
+func (h *Handler) handleEvents(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return // Upgrade has already replied with an error
+	}
+	defer conn.Close()
+
+	bus := h.Provider.Events()
+	ch := bus.Subscribe()
+	defer bus.Unsubscribe(ch)
+
+	// The browser never sends anything, reading only notices when it goes away
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	send := func(ev events.Event) error {
+		conn.SetWriteDeadline(time.Now().Add(eventsWriteTimeout))
+		return conn.WriteJSON(ev)
+	}
+	if err := send(events.Event{Type: events.Status, Time: time.Now(), Data: h.Provider.GetStatus()}); err != nil {
+		return
+	}
+
+	ping := time.NewTicker(eventsPingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case <-gone:
+			return
+		case ev, ok := <-ch:
+			if !ok {
+				return
+			}
+			if err := send(ev); err != nil {
+				return
+			}
+		case <-ping.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(eventsWriteTimeout)); err != nil {
+				return
+			}
+		}
+	}
+}
+
 func (h *Handler) handleTunnels(w http.ResponseWriter, r *http.Request) {
 	if r.Method == http.MethodPost {
 		var t config.Tunnel
@@ -82,39 +389,234 @@ func (h *Handler) handleTunnels(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		if err := h.Provider.AddTunnel(t); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		if err := h.addTunnel(r, t); err != nil {
+			http.Error(w, err.Error(), err.status())
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if r.Method == http.MethodPut {
+		var t config.Tunnel
+		if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		replace := func(config.Tunnel) (config.Tunnel, *apiError) { return t, nil }
+		if err := h.updateTunnel(r, t.Name, replace); err != nil {
+			http.Error(w, err.Error(), err.status())
 			return
 		}
-		// Also update config file
-		h.Config.Client.Tunnels = append(h.Config.Client.Tunnels, t)
-		config.SaveConfig(h.ConfigPath, h.Config)
 		w.WriteHeader(http.StatusOK)
 		return
 	}
 	
 	if r.Method == http.MethodDelete {
-		name := r.URL.Query().Get("name")
-		if err := h.Provider.RemoveTunnel(name); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		if err := h.removeTunnel(r, r.URL.Query().Get("name")); err != nil {
+			http.Error(w, err.Error(), err.status())
 			return
 		}
-		// Update config file
-		for i, t := range h.Config.Client.Tunnels {
-			if t.Name == name {
-				h.Config.Client.Tunnels = append(h.Config.Client.Tunnels[:i], h.Config.Client.Tunnels[i+1:]...)
-				break
-			}
-		}
-		config.SaveConfig(h.ConfigPath, h.Config)
 		w.WriteHeader(http.StatusOK)
 		return
 	}
 }
 
+// apiError is an error of a change made through the API, with the code the v1 API reports.
+type apiError struct {
+	code    string
+	message string
+}
+
+func (e *apiError) Error() string {
+	return e.message
+}
+
+func (e *apiError) status() int {
+	switch e.code {
+	case api.CodeBadRequest:
+		return http.StatusBadRequest
+	case api.CodeNotFound:
+		return http.StatusNotFound
+	case api.CodeConflict:
+		return http.StatusConflict
+	case api.CodePreconditionFailed:
+		return http.StatusPreconditionFailed
+	case api.CodePreconditionReq:
+		return http.StatusPreconditionRequired
+	case api.CodeUnsupported:
+		return http.StatusNotImplemented
+	case api.CodeRegistrationFailed:
+		return http.StatusBadGateway
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func newAPIError(code, format string, args ...interface{}) *apiError {
+	return &apiError{code: code, message: fmt.Sprintf(format, args...)}
+}
+
+// tunnelIndex returns the position of the named tunnel in the client config, or -1.
+func (h *Handler) tunnelIndex(name string) int {
+	for i, t := range h.Config.Client.Tunnels {
+		if t.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// addTunnel registers a new client tunnel and saves it to the config file.
+func (h *Handler) addTunnel(r *http.Request, t config.Tunnel) (err *apiError) {
+	defer func() {
+		h.audit(r, api.AuditTunnelAdd, t.Name, audit.Diff(nil, t, nil, t.Redacted()), err)
+	}()
+	if h.Config.Mode != "client" {
+		return newAPIError(api.CodeUnsupported, "tunnels can only be added in client mode")
+	}
+	if t.Name == "" {
+		return newAPIError(api.CodeBadRequest, "tunnel name is required")
+	}
+
+	h.configMu.Lock()
+	defer h.configMu.Unlock()
+	if h.tunnelIndex(t.Name) >= 0 {
+		return newAPIError(api.CodeConflict, "tunnel %s already exists", t.Name)
+	}
+	if err := h.Provider.AddTunnel(t); err != nil {
+		return newAPIError(api.CodeRegistrationFailed, "%v", err)
+	}
+	h.Config.Client.Tunnels = append(h.Config.Client.Tunnels, t)
+	if err := config.SaveConfig(h.ConfigPath, h.Config); err != nil {
+		return newAPIError(api.CodeInternal, "tunnel added but config not saved: %v", err)
+	}
+	return nil
+}
+
+// updateTunnel applies new settings to a client tunnel and saves them to the config
+// file. The settings are made by edit from the current ones, under the same hold
+// of the config lock as the save, so concurrent updates are not lost. The tunnel
+// stays registered, the server keeps its port open unless remote_port changes,
+// and open connections are not interrupted.
+func (h *Handler) updateTunnel(r *http.Request, name string, edit func(current config.Tunnel) (config.Tunnel, *apiError)) (err *apiError) {
+	var changes []api.AuditChange
+	defer func() {
+		h.audit(r, api.AuditTunnelUpdate, name, changes, err)
+	}()
+	if h.Config.Mode != "client" {
+		return newAPIError(api.CodeUnsupported, "tunnels can only be changed in client mode")
+	}
+
+	h.configMu.Lock()
+	defer h.configMu.Unlock()
+	i := h.tunnelIndex(name)
+	if i < 0 {
+		return newAPIError(api.CodeNotFound, "tunnel %s not found", name)
+	}
+	old := h.Config.Client.Tunnels[i]
+	t, err := edit(old)
+	if err != nil {
+		return err
+	}
+	if t.Name != name {
+		return newAPIError(api.CodeBadRequest, "tunnels cannot be renamed")
+	}
+	// Secrets sent back masked keep their value
+	t = t.WithSecretsFrom(old)
+	changes = audit.Diff(old, t, old.Redacted(), t.Redacted())
+	if err := h.Provider.UpdateTunnel(t); err != nil {
+		return newAPIError(api.CodeRegistrationFailed, "%v", err)
+	}
+	h.Config.Client.Tunnels[i] = t
+	if err := config.SaveConfig(h.ConfigPath, h.Config); err != nil {
+		return newAPIError(api.CodeInternal, "tunnel updated but config not saved: %v", err)
+	}
+	return nil
+}
+
+// removeTunnel removes a client tunnel and saves the config file.
+func (h *Handler) removeTunnel(r *http.Request, name string) (err *apiError) {
+	var changes []api.AuditChange
+	defer func() {
+		h.audit(r, api.AuditTunnelRemove, name, changes, err)
+	}()
+	if h.Config.Mode != "client" {
+		return newAPIError(api.CodeUnsupported, "tunnels can only be removed in client mode")
+	}
+
+	h.configMu.Lock()
+	defer h.configMu.Unlock()
+	i := h.tunnelIndex(name)
+	if i < 0 {
+		return newAPIError(api.CodeNotFound, "tunnel %s not found", name)
+	}
+	old := h.Config.Client.Tunnels[i]
+	changes = audit.Diff(old, nil, old.Redacted(), nil)
+	if err := h.Provider.RemoveTunnel(name); err != nil {
+		return newAPIError(api.CodeInternal, "%v", err)
+	}
+	tunnels := append([]config.Tunnel{}, h.Config.Client.Tunnels[:i]...)
+	h.Config.Client.Tunnels = append(tunnels, h.Config.Client.Tunnels[i+1:]...)
+	if err := config.SaveConfig(h.ConfigPath, h.Config); err != nil {
+		return newAPIError(api.CodeInternal, "tunnel removed but config not saved: %v", err)
+	}
+	return nil
+}
+
+// saveConfig replaces the whole config and writes it to the config file,
+// recording action on target to the audit log. It fails if the request's
+// If-Match header names another version of the config than the current one.
+// It returns the ETag of the new config.
+func (h *Handler) saveConfig(r *http.Request, action, target string, cfg config.Config) (etag string, err *apiError) {
+	h.configMu.Lock()
+	defer h.configMu.Unlock()
+	old := *h.Config
+	defer func() {
+		h.audit(r, action, target, audit.Diff(old, cfg, old.Redacted(), cfg.Redacted()), err)
+	}()
+	if !ifMatch(r, configETag(h.Config)) {
+		return "", newAPIError(api.CodePreconditionFailed, "the config was changed by someone else, reload it and try again")
+	}
+	if err := config.SaveConfig(h.ConfigPath, &cfg); err != nil {
+		return "", newAPIError(api.CodeInternal, "%v", err)
+	}
+	*h.Config = cfg
+	return configETag(h.Config), nil
+}
+
+func (h *Handler) handleInspect(w http.ResponseWriter, r *http.Request) {
+	records, err := h.Provider.GetInspections(r.URL.Query().Get("tunnel"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	json.NewEncoder(w).Encode(records)
+}
+
+func (h *Handler) handleReplay(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := strconv.ParseUint(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+	record, err := h.Provider.ReplayRequest(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(record)
+}
+
 func (h *Handler) handleConfig(w http.ResponseWriter, r *http.Request) {
 	if r.Method == http.MethodGet {
-		json.NewEncoder(w).Encode(h.Config)
+		cfg, etag := h.currentConfig(r)
+		w.Header().Set("ETag", etag)
+		json.NewEncoder(w).Encode(cfg)
 		return
 	}
 
@@ -124,17 +626,24 @@ func (h *Handler) handleConfig(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
+		if err := requireIfMatch(r); err != nil {
+			http.Error(w, err.Error(), err.status())
+			return
+		}
+		if err := newCfg.Validate(); err != nil {
+			http.Error(w, "invalid config: "+err.Error(), http.StatusBadRequest)
+			return
+		}
 
 		// Update in-memory config
 		// Note: This won't reload the running server/client logic automatically in this simple version.
 		// A restart is required.
-		*h.Config = newCfg
-
-		// Save to file
-		if err := config.SaveConfig(h.ConfigPath, &newCfg); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		etag, err := h.saveConfig(r, api.AuditConfigSave, h.ConfigPath, newCfg)
+		if err != nil {
+			http.Error(w, err.Error(), err.status())
 			return
 		}
+		w.Header().Set("ETag", etag)
 
 		w.WriteHeader(http.StatusOK)
 		json.NewEncoder(w).Encode(map[string]string{"status": "saved", "message": "Configuration saved. Please restart the application to apply changes."})